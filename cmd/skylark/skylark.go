@@ -24,6 +24,10 @@ import (
 var (
 	cpuprofile = flag.String("cpuprofile", "", "gather CPU profile in this file")
 	showenv    = flag.Bool("showenv", false, "on success, print final global environment")
+
+	// thread options
+	dictsetorder = flag.Bool("dictsetorder", false, "allow ordered comparison of dicts and sets")
+	dictviews    = flag.Bool("dictviews", false, "dict keys, values, and items methods return views")
 )
 
 // non-standard dialect flags
@@ -33,6 +37,7 @@ func init() {
 	flag.BoolVar(&resolve.AllowLambda, "lambda", resolve.AllowLambda, "allow lambda expressions")
 	flag.BoolVar(&resolve.AllowNestedDef, "nesteddef", resolve.AllowNestedDef, "allow nested def statements")
 	flag.BoolVar(&resolve.AllowBitwise, "bitwise", resolve.AllowBitwise, "allow bitwise operations (&, |, ^, ~, <<, and >>)")
+	flag.BoolVar(&resolve.AllowPositionalOnly, "positionalonly", resolve.AllowPositionalOnly, "allow positional-only parameters")
 }
 
 func main() {
@@ -52,6 +57,8 @@ func main() {
 	}
 
 	thread := &skylark.Thread{Load: repl.MakeLoad()}
+	thread.SetDictSetOrder(*dictsetorder)
+	thread.SetDictViews(*dictviews)
 	globals := make(skylark.StringDict)
 
 	switch len(flag.Args()) {
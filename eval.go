@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"math/big"
 	"sort"
 	"strings"
@@ -31,25 +30,296 @@ type Thread struct {
 	frame *Frame
 
 	// Print is the client-supplied implementation of the Skylark
-	// 'print' function. If nil, fmt.Fprintln(os.Stderr, msg) is
-	// used instead.
+	// 'print' function. The message excludes the default end, a
+	// newline, but if the call specifies end, the message is the
+	// printed text including end, unmodified. (So print("a") and
+	// print("a", end="") both print "a"; clients that must tell
+	// them apart should use Output.) If nil, the text is written
+	// to Output instead.
 	Print func(thread *Thread, msg string)
 
+	// Output is the writer to which 'print' writes its text,
+	// including the final newline, if Print is nil.
+	// If Output is also nil, the text is written to os.Stderr.
+	Output io.Writer
+
+	// PrintWithPosition causes 'print' to prefix its text with the
+	// "file:line: " position of the call, whether the text is passed
+	// to Print or written to Output.
+	PrintWithPosition bool
+
 	// Load is the client-supplied implementation of module loading.
 	// Repeated calls with the same module name must return the same
 	// module environment or error.
 	// The error message need not include the module name.
 	//
+	// The evaluator memoizes the result of Load for each module name
+	// within a single thread, so a module loaded several times by the
+	// same thread is requested only once.  A load of a module whose
+	// loading is already in progress on the same thread fails with a
+	// "cycle in load graph" error.  Clients that load each module in a
+	// new thread, or share modules across threads, must still provide
+	// their own cache and cycle detection.
+	// The module environment is frozen before its values are bound.
+	//
 	// See example_test.go for some example implementations of Load.
 	Load func(thread *Thread, module string) (StringDict, error)
 
+	// loads records the result of each call to Load, by module name.
+	// A nil entry indicates a load in progress.
+	loads map[string]*loadEntry
+
 	// locals holds arbitrary "thread-local" Go values belonging to the client.
 	// They are accessible to the client but not to any Skylark program.
 	locals map[string]interface{}
+
+	// depth is the number of active calls (Skylark or built-in).
+	depth int
+
+	// maxDepth is the maximum call depth, or zero for the default.
+	maxDepth int
+
+	// steps is the number of bytecode instructions executed.
+	steps uint64
+
+	// maxSteps is the step count at which execution fails,
+	// or zero for no limit.
+	maxSteps uint64
+
+	// allocs is the number of elements allocated, as defined by Allocs.
+	allocs uint64
+
+	// maxAllocs is the allocation count at which execution fails,
+	// or zero for no limit.
+	maxAllocs uint64
+
+	// maxFormatSize is the maximum length of a formatted string,
+	// or zero for no limit.
+	maxFormatSize int
+
+	// dictSetOrder enables ordered comparison of dicts and sets.
+	dictSetOrder bool
+
+	// dictViews causes the dict keys, values, and items methods
+	// to return views instead of lists.
+	dictViews bool
+
+	// valueIDs maps the idKey of each immutable value passed to the
+	// id built-in to its identity, or is nil if there are none.
+	valueIDs *Dict
+
+	// memoCaches holds the result cache of each memoized function
+	// called by the thread, or is nil if there are none.
+	memoCaches map[*memoized]*Dict
+
+	// interned maps each string key inserted into a dict to its
+	// canonical copy, or is nil if interning is disabled.
+	interned map[string]String
+}
+
+// defaultMaxDepth is the maximum call depth of a thread
+// whose limit has not been set by SetMaxDepth.
+const defaultMaxDepth = 1000
+
+// SetMaxDepth sets the maximum depth of nested calls (including calls
+// to built-ins) that may be active within the thread.  A call that
+// would exceed the limit fails with a "maximum recursion depth
+// exceeded" error instead of exhausting the Go stack.
+// A value of zero or less restores the default limit.
+func (thread *Thread) SetMaxDepth(n int) {
+	if n < 0 {
+		n = 0
+	}
+	thread.maxDepth = n
+}
+
+// Steps returns the number of bytecode instructions executed by the
+// thread so far.  It is a rough measure of the cost of execution.
+func (thread *Thread) Steps() uint64 { return thread.steps }
+
+// SetMaxSteps sets the maximum number of steps (bytecode instructions)
+// the thread may execute in total.  Execution beyond the limit fails
+// with a "step limit exceeded" error.  A value of zero removes the limit.
+//
+// The limit applies to the value of Steps, which is not reset by
+// this call, so a limit lower than the current value takes effect
+// at the next step.
+func (thread *Thread) SetMaxSteps(n uint64) {
+	thread.maxSteps = n
+}
+
+// Allocs returns the number of elements allocated by the thread so far.
+// It is a rough measure of the memory used by execution.
+//
+// Each element of a list, tuple, set, or dict created by a literal or
+// a comprehension, by concatenation (x + y) or repetition (x * n), or
+// by a built-in that consumes an iterable, such as list, sorted, zip,
+// or list.extend, counts as one, as does each byte of a string created
+// by concatenation, repetition, formatting (% or string.format), or
+// another string method.  Other allocations, including those of
+// application-defined built-ins, are not counted.
+func (thread *Thread) Allocs() uint64 { return thread.allocs }
+
+// SetMaxAllocs sets the maximum number of elements the thread may
+// allocate in total, as counted by Allocs.  An operation that would
+// exceed the limit fails with an "allocation limit exceeded" error.
+// A value of zero removes the limit.
+//
+// As with SetMaxSteps, the limit applies to the current value of Allocs,
+// which is not reset by this call.
+func (thread *Thread) SetMaxAllocs(n uint64) {
+	thread.maxAllocs = n
+}
+
+// SetMaxFormatSize sets the maximum length in bytes of a string
+// produced by the % operator or the string.format method.  Formatting
+// fails with a "formatted string too large" error as soon as the result
+// exceeds the limit, so that a template that repeats a large argument
+// many times cannot exhaust memory.  A value of zero or less removes
+// the limit.
+func (thread *Thread) SetMaxFormatSize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	thread.maxFormatSize = n
+}
+
+// SetDictSetOrder enables or disables the ordered comparison
+// (<, <=, >, >=) of dicts and sets by the thread's comparison
+// operators and its calls to sorted, min, and max.
+// It is disabled by default, as in Python.
+func (thread *Thread) SetDictSetOrder(enable bool) {
+	thread.dictSetOrder = enable
+}
+
+// SetDictViews enables or disables views: if enabled, the dict keys,
+// values, and items methods called by the thread return live views of
+// the dict, like iterkeys, itervalues, and iteritems, instead of lists.
+// It is disabled by default.
+func (thread *Thread) SetDictViews(enable bool) {
+	thread.dictViews = enable
+}
+
+// compare is like Compare, but applies the thread's options.
+func (thread *Thread) compare(op syntax.Token, x, y Value) (bool, error) {
+	if thread != nil && thread.dictSetOrder {
+		return compareOrdered(op, x, y, maxdepth)
+	}
+	return Compare(op, x, y)
+}
+
+// alloc adds n to the thread's allocation count, or reports an error
+// if that would exceed the limit.
+func (thread *Thread) alloc(n uint64) error {
+	if thread == nil {
+		return nil
+	}
+	total := thread.allocs + n
+	if total > thread.maxAllocs && thread.maxAllocs != 0 {
+		return fmt.Errorf("allocation limit exceeded")
+	}
+	thread.allocs = total
+	return nil
+}
+
+// allocSize returns the number of elements in x counted by Allocs:
+// the length of a string, list, tuple, or dict, or zero for other types.
+func allocSize(x Value) uint64 {
+	switch x := x.(type) {
+	case String:
+		return uint64(len(x))
+	case *List:
+		return uint64(x.Len())
+	case Tuple:
+		return uint64(len(x))
+	case *Dict:
+		return uint64(x.Len())
+	}
+	return 0
+}
+
+// repeatSize returns the number of elements in the result of x * y,
+// if it is the repetition of a string, list, or tuple, or else zero.
+// It is computed before the result is allocated.
+func repeatSize(x, y Value) uint64 {
+	if _, ok := x.(Int); ok {
+		x, y = y, x
+	}
+	n, ok := y.(Int)
+	if !ok {
+		return 0
+	}
+	i, err := AsInt32(n)
+	if err != nil || i <= 0 {
+		return 0
+	}
+	return allocSize(x) * uint64(i)
+}
+
+// SetInternKeys enables or disables interning of dict keys.
+// When enabled, each string key that the thread's Skylark code
+// inserts into a dictionary, whether by a dict literal or an
+// assignment d[k] = v, is replaced by an equal string encountered
+// earlier, so that the many dicts of a large program with
+// overlapping keys share a single copy of each key.
+// Interning does not affect the equality or hash of any value,
+// but the table retains every distinct key for the life of the thread.
+func (thread *Thread) SetInternKeys(enabled bool) {
+	if !enabled {
+		thread.interned = nil
+	} else if thread.interned == nil {
+		thread.interned = make(map[string]String)
+	}
+}
+
+// internKey returns the canonical copy of k if k is a string and
+// interning is enabled, and k otherwise.
+func (thread *Thread) internKey(k Value) Value {
+	if s, ok := k.(String); ok && thread.interned != nil {
+		if canon, ok := thread.interned[string(s)]; ok {
+			return canon
+		}
+		thread.interned[string(s)] = s
+	}
+	return k
+}
+
+type loadEntry struct {
+	globals StringDict
+	err     error
+}
+
+// load calls thread.Load, memoizing its result and detecting cycles.
+func (thread *Thread) load(module string) (StringDict, error) {
+	e, ok := thread.loads[module]
+	if e == nil {
+		if ok {
+			// request for module whose loading is in progress
+			return nil, fmt.Errorf("cycle in load graph")
+		}
+
+		if thread.loads == nil {
+			thread.loads = make(map[string]*loadEntry)
+		}
+		thread.loads[module] = nil // load in progress
+
+		globals, err := thread.Load(thread, module)
+		if err == nil {
+			globals.Freeze()
+		}
+		e = &loadEntry{globals, err}
+		thread.loads[module] = e
+	}
+	return e.globals, e.err
 }
 
 // SetLocal sets the thread-local value associated with the specified key.
-// It must not be called after execution begins.
+//
+// Thread-local values hold state belonging to the client, such as an
+// accumulator or a file handle, for the duration of an evaluation.
+// They are not visible to Skylark programs, and each Thread has its own.
+// A client may set them before execution begins, or a built-in function
+// may set them during execution, to be retrieved by later calls.
 func (thread *Thread) SetLocal(key string, value interface{}) {
 	if thread.locals == nil {
 		thread.locals = make(map[string]interface{})
@@ -57,7 +327,8 @@ func (thread *Thread) SetLocal(key string, value interface{}) {
 	thread.locals[key] = value
 }
 
-// Local returns the thread-local value associated with the specified key.
+// Local returns the thread-local value associated with the specified key,
+// or nil if there is none.
 func (thread *Thread) Local(key string) interface{} {
 	return thread.locals[key]
 }
@@ -227,7 +498,9 @@ func (prog *Program) Write(out io.Writer) error { return prog.compiled.Write(out
 // its values.
 //
 // If ExecFile fails during evaluation, it returns an *EvalError
-// containing a backtrace.
+// containing a backtrace, along with the (partial) frozen globals
+// defined before the failure, which may be useful for debugging.
+// Global variables not yet assigned are absent from the dictionary.
 func ExecFile(thread *Thread, filename string, src interface{}, predeclared StringDict) (StringDict, error) {
 	// Parse, resolve, and compile a Skylark source file.
 	_, mod, err := SourceProgram(filename, src, predeclared.Has)
@@ -264,6 +537,70 @@ func SourceProgram(filename string, src interface{}, isPredeclared func(string)
 	return f, &Program{compiled}, nil
 }
 
+// UnusedGlobals returns the names of the global variables of file f
+// that are assigned a value in globals, the result of executing f, but
+// that are never read by f, in order of declaration.  It is intended
+// for linting.  The file must have been resolved, for example by
+// SourceProgram.
+//
+// Globals that are unused by f may still be used by other modules
+// that load f, so clients may wish to ignore some names, such as
+// those not beginning with an underscore.
+func UnusedGlobals(f *syntax.File, globals StringDict) []string {
+	// binding records the identifiers that bind names.
+	binding := make(map[*syntax.Ident]bool)
+	var bind func(lhs syntax.Expr)
+	bind = func(lhs syntax.Expr) {
+		switch lhs := lhs.(type) {
+		case *syntax.Ident:
+			binding[lhs] = true
+		case *syntax.ParenExpr:
+			bind(lhs.X)
+		case *syntax.TupleExpr:
+			for _, elem := range lhs.List {
+				bind(elem)
+			}
+		case *syntax.ListExpr:
+			for _, elem := range lhs.List {
+				bind(elem)
+			}
+		}
+	}
+
+	// Every other reference to a global is a read.
+	// (Walk visits each statement before the identifiers within it.)
+	read := make(map[string]bool)
+	syntax.Walk(f, func(n syntax.Node) bool {
+		switch n := n.(type) {
+		case *syntax.AssignStmt:
+			if n.Op == syntax.EQ { // x += y reads x
+				bind(n.LHS)
+			}
+		case *syntax.DefStmt:
+			binding[n.Name] = true
+		case *syntax.ForStmt:
+			bind(n.Vars)
+		case *syntax.LoadStmt:
+			for _, id := range n.To {
+				binding[id] = true
+			}
+		case *syntax.Ident:
+			if !binding[n] && n.Scope == uint8(resolve.Global) {
+				read[n.Name] = true
+			}
+		}
+		return true
+	})
+
+	var unused []string
+	for _, id := range f.Globals {
+		if globals.Has(id.Name) && !read[id.Name] {
+			unused = append(unused, id.Name)
+		}
+	}
+	return unused
+}
+
 // CompiledProgram produces a new program from the representation
 // of a compiled program previously saved by Program.Write.
 func CompiledProgram(in io.Reader) (*Program, error) {
@@ -344,18 +681,25 @@ func Eval(thread *Thread, filename string, src interface{}, env StringDict) (Val
 // The following functions are primitive operations of the byte code interpreter.
 
 // list += iterable
-func listExtend(x *List, y Iterable) {
+func listExtend(thread *Thread, x *List, y Iterable) error {
 	if ylist, ok := y.(*List); ok {
 		// fast path: list += list
+		if err := thread.alloc(uint64(len(ylist.elems))); err != nil {
+			return err
+		}
 		x.elems = append(x.elems, ylist.elems...)
-	} else {
-		iter := y.Iterate()
-		defer iter.Done()
-		var z Value
-		for iter.Next(&z) {
-			x.elems = append(x.elems, z)
+		return nil
+	}
+	iter := IterateThread(thread, y)
+	defer iter.Done()
+	var z Value
+	for iter.Next(&z) {
+		if err := thread.alloc(1); err != nil {
+			return err
 		}
+		x.elems = append(x.elems, z)
 	}
+	return IterErr(iter)
 }
 
 // getAttr implements x.dot.
@@ -464,7 +808,11 @@ func Unary(op syntax.Token, x Value) (Value, error) {
 
 // Binary applies a strict binary operator (not AND or OR) to its operands.
 // For equality tests or ordered comparisons, use Compare instead.
-func Binary(op syntax.Token, x, y Value) (Value, error) {
+func Binary(op syntax.Token, x, y Value) (Value, error) { return binary(nil, op, x, y) }
+
+// binary is like Binary, but applies the limits of the specified
+// thread, if non-nil.
+func binary(thread *Thread, op syntax.Token, x, y Value) (Value, error) {
 	switch op {
 	case syntax.PLUS:
 		switch x := x.(type) {
@@ -674,7 +1022,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				if y == 0.0 {
 					return nil, fmt.Errorf("float modulo by zero")
 				}
-				return Float(math.Mod(float64(x), float64(y))), nil
+				return x.Mod(y), nil
 			case Int:
 				if y.Sign() == 0 {
 					return nil, fmt.Errorf("float modulo by zero")
@@ -682,7 +1030,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				return x.Mod(y.Float()), nil
 			}
 		case String:
-			return interpolate(string(x), y)
+			return interpolate(thread, string(x), y)
 		}
 
 	case syntax.NOT_IN:
@@ -742,9 +1090,18 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			}
 		case *Set: // union
 			if y, ok := y.(*Set); ok {
-				iter := Iterate(y)
-				defer iter.Done()
-				return x.Union(iter)
+				return setUnion(x, y)
+			}
+		case *Dict: // merge
+			if y, ok := y.(*Dict); ok {
+				z := new(Dict)
+				for _, item := range x.Items() {
+					z.SetKey(item[0], item[1])
+				}
+				for _, item := range y.Items() {
+					z.SetKey(item[0], item[1])
+				}
+				return z, nil
 			}
 		}
 
@@ -756,17 +1113,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			}
 		case *Set: // intersection
 			if y, ok := y.(*Set); ok {
-				set := new(Set)
-				if x.Len() > y.Len() {
-					x, y = y, x // opt: range over smaller set
-				}
-				for _, xelem := range x.elems() {
-					// Has, Insert cannot fail here.
-					if found, _ := y.Has(xelem); found {
-						set.Insert(xelem)
-					}
-				}
-				return set, nil
+				return setIntersection(x, y), nil
 			}
 		}
 
@@ -853,8 +1200,18 @@ func Call(thread *Thread, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
 		return nil, fmt.Errorf("invalid call of non-function (%s)", fn.Type())
 	}
 
+	max := thread.maxDepth
+	if max == 0 {
+		max = defaultMaxDepth
+	}
+	if thread.depth >= max {
+		return nil, fmt.Errorf("maximum recursion depth exceeded")
+	}
+
 	thread.frame = &Frame{parent: thread.frame, callable: c}
+	thread.depth++
 	result, err := c.CallInternal(thread, args, kwargs)
+	thread.depth--
 	thread.frame = thread.frame.parent
 
 	// Sanity check: nil is not a valid Skylark value.
@@ -880,7 +1237,7 @@ func slice(x, lo, hi, step_ Value) (Value, error) {
 			return nil, fmt.Errorf("got %s for slice step, want int", step_.Type())
 		}
 		if step == 0 {
-			return nil, fmt.Errorf("zero is not a valid slice step")
+			return nil, fmt.Errorf("slice step cannot be zero")
 		}
 	}
 
@@ -1040,10 +1397,14 @@ func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 		}
 
 		// keyword arguments
+		// Positional-only parameters cannot be set by keyword,
+		// though their names may appear in **kwargs.
+		npos := fn.NumPositionalOnly()
 		paramIdents := fn.funcode.Locals[:nparams]
 		for _, pair := range kwargs {
 			k, v := pair[0].(String), pair[1]
-			if i := findParam(paramIdents, string(k)); i >= 0 {
+			if i := findParam(paramIdents[npos:], string(k)); i >= 0 {
+				i += npos
 				if defined.set(i) {
 					return fmt.Errorf("function %s got multiple values for keyword argument %s", fn.Name(), k)
 				}
@@ -1051,6 +1412,9 @@ func setArgs(locals []Value, fn *Function, args Tuple, kwargs []Tuple) error {
 				continue
 			}
 			if kwdict == nil {
+				if findParam(paramIdents[:npos], string(k)) >= 0 {
+					return fmt.Errorf("function %s got positional-only argument %s passed as keyword argument", fn.Name(), k)
+				}
 				return fmt.Errorf("function %s got an unexpected keyword argument %s", fn.Name(), k)
 			}
 			kwdict.SetKey(k, v)
@@ -1138,12 +1502,24 @@ func (is *intset) len() int {
 	return len(is.large)
 }
 
+// checkFormatSize returns an error if buf exceeds the thread's limit
+// on the size of formatted strings.  A nil thread has no limit.
+func checkFormatSize(thread *Thread, buf *bytes.Buffer) error {
+	if thread != nil && thread.maxFormatSize > 0 && buf.Len() > thread.maxFormatSize {
+		return fmt.Errorf("formatted string too large")
+	}
+	return nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#string-interpolation
-func interpolate(format string, x Value) (Value, error) {
+func interpolate(thread *Thread, format string, x Value) (Value, error) {
 	var buf bytes.Buffer
 	path := make([]Value, 0, 4)
 	index := 0
 	for {
+		if err := checkFormatSize(thread, &buf); err != nil {
+			return nil, err
+		}
 		i := strings.IndexByte(format, '%')
 		if i < 0 {
 			buf.WriteString(format)
@@ -1200,12 +1576,10 @@ func interpolate(format string, x Value) (Value, error) {
 			return nil, fmt.Errorf("incomplete format")
 		}
 		switch c := format[0]; c {
-		case 's', 'r':
-			if str, ok := AsString(arg); ok && c == 's' {
-				buf.WriteString(str)
-			} else {
-				writeValue(&buf, arg, path)
-			}
+		case 's':
+			writeStr(&buf, arg, path)
+		case 'r':
+			writeValue(&buf, arg, path)
 		case 'd', 'i', 'o', 'x', 'X':
 			i, err := NumberToInt(arg)
 			if err != nil {
@@ -1270,6 +1644,9 @@ func interpolate(format string, x Value) (Value, error) {
 	if tuple, ok := x.(Tuple); ok && index < len(tuple) {
 		return nil, fmt.Errorf("too many arguments for format string")
 	}
+	if err := checkFormatSize(thread, &buf); err != nil {
+		return nil, err
+	}
 
 	return String(buf.String()), nil
 }
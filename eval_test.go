@@ -9,8 +9,11 @@ import (
 	"fmt"
 	"math"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/google/skylark"
 	"github.com/google/skylark/internal/chunkedfile"
@@ -26,6 +29,7 @@ func init() {
 	resolve.AllowFloat = true
 	resolve.AllowSet = true
 	resolve.AllowBitwise = true
+	resolve.AllowPositionalOnly = true
 }
 
 func TestEvalExpr(t *testing.T) {
@@ -233,6 +237,56 @@ func (hf *hasfields) Binary(op syntax.Token, y skylark.Value, side skylark.Side)
 	return nil, nil
 }
 
+// errAttrs is an application-defined HasAttrs with an attribute "ok"
+// and an attribute "bad" whose value cannot be computed.
+// Like many implementations, it reports a missing attribute as an error.
+type errAttrs struct{}
+
+func (errAttrs) String() string        { return "errattrs" }
+func (errAttrs) Type() string          { return "errattrs" }
+func (errAttrs) Freeze()               {}
+func (errAttrs) Truth() skylark.Bool   { return true }
+func (errAttrs) Hash() (uint32, error) { return 0, nil }
+func (errAttrs) AttrNames() []string   { return []string{"bad", "ok"} }
+
+func (errAttrs) Attr(name string) (skylark.Value, error) {
+	switch name {
+	case "ok":
+		return skylark.MakeInt(1), nil
+	case "bad":
+		return nil, fmt.Errorf("cannot compute .bad")
+	}
+	return nil, fmt.Errorf("errattrs has no .%s attribute (did you mean .ok?)", name)
+}
+
+// TestAttrErrors checks that getattr and hasattr distinguish a missing
+// attribute from one whose value cannot be computed.
+func TestAttrErrors(t *testing.T) {
+	predeclared := skylark.StringDict{"x": errAttrs{}}
+	for _, test := range []struct{ src, want string }{
+		{`hasattr(x, "ok")`, "True"},
+		{`hasattr(x, "nope")`, "False"},
+		{`hasattr(x, "bad")`, "error: cannot compute .bad"},
+		{`getattr(x, "ok")`, "1"},
+		{`getattr(x, "ok", 0)`, "1"},
+		{`getattr(x, "nope", 0)`, "0"},
+		{`getattr(x, "nope")`, "error: errattrs has no .nope attribute (did you mean .ok?)"},
+		{`getattr(x, "bad")`, "error: cannot compute .bad"},
+		{`getattr(x, "bad", 0)`, "error: cannot compute .bad"},
+		{`x.bad`, "error: cannot compute .bad"},
+	} {
+		var got string
+		if v, err := skylark.Eval(new(skylark.Thread), "<expr>", test.src, predeclared); err != nil {
+			got = "error: " + err.(*skylark.EvalError).Msg
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
 func TestParameterPassing(t *testing.T) {
 	const filename = "parameters.go"
 	const src = `
@@ -338,6 +392,411 @@ f()
 	}
 }
 
+// TestPrintWithPosition tests that Thread.PrintWithPosition
+// prefixes printed text with the position of the call.
+func TestPrintWithPosition(t *testing.T) {
+	const src = `
+print("hello")
+def f(): print("world", end="")
+f()
+`
+	for _, withPosn := range []bool{false, true} {
+		var printed []string
+		thread := &skylark.Thread{
+			Print:             func(_ *skylark.Thread, msg string) { printed = append(printed, msg) },
+			PrintWithPosition: withPosn,
+		}
+		if _, err := skylark.ExecFile(thread, "foo.sky", src, nil); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"hello", "world"}
+		if withPosn {
+			want = []string{"foo.sky:2: hello", "foo.sky:3: world"}
+		}
+		if got := strings.Join(printed, "|"); got != strings.Join(want, "|") {
+			t.Errorf("PrintWithPosition=%t: got %q, want %q", withPosn, printed, want)
+		}
+
+		buf := new(bytes.Buffer)
+		thread = &skylark.Thread{Output: buf, PrintWithPosition: withPosn}
+		if _, err := skylark.ExecFile(thread, "foo.sky", src, nil); err != nil {
+			t.Fatal(err)
+		}
+		wantOut := "hello\nworld"
+		if withPosn {
+			wantOut = "foo.sky:2: hello\nfoo.sky:3: world"
+		}
+		if got := buf.String(); got != wantOut {
+			t.Errorf("PrintWithPosition=%t: output was %q, want %q", withPosn, got, wantOut)
+		}
+	}
+}
+
+// TestPrintSepEnd tests the sep and end parameters of print.
+func TestPrintSepEnd(t *testing.T) {
+	for _, test := range []struct {
+		src, want string
+	}{
+		{`print(1, "a", x=2)`, `1 a x=2`},
+		{`print(1, 2, sep=", ")`, `1, 2`},
+		{`print(1, 2, sep="")`, `12`},
+		{`print(1, 2, sep=None, end=None)`, `1 2`},
+		{`print(1, 2, x=3, sep="-")`, `1-2-x=3`},
+		{`print("a", end="")`, `a`},
+		{`print("a", end="!\n")`, "a!\n"},
+		{`print("a", end="\n\n")`, "a\n\n"},
+		{`print("a", end="\n")`, "a\n"},
+		{`print("a", sep=1)`, `print: for parameter sep: got int, want string or None`},
+		{`print("a", end=[])`, `print: for parameter end: got list, want string or None`},
+	} {
+		var got string
+		thread := &skylark.Thread{
+			Print: func(_ *skylark.Thread, msg string) { got = msg },
+		}
+		if _, err := skylark.ExecFile(thread, "print.sky", test.src, nil); err != nil {
+			got = err.(*skylark.EvalError).Msg
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.src, got, test.want)
+		}
+	}
+}
+
+// TestPrintOutput tests that print writes to Thread.Output
+// unless Thread.Print is set.
+func TestPrintOutput(t *testing.T) {
+	const src = `
+print("hello")
+print("a", "b", sep="", end="")
+print(1)
+`
+	buf := new(bytes.Buffer)
+	thread := &skylark.Thread{Output: buf}
+	if _, err := skylark.ExecFile(thread, "print.sky", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "hello\nab1\n"; got != want {
+		t.Errorf("output was %q, want %q", got, want)
+	}
+
+	// Print takes precedence over Output.
+	buf.Reset()
+	var printed []string
+	thread = &skylark.Thread{
+		Output: buf,
+		Print:  func(_ *skylark.Thread, msg string) { printed = append(printed, msg) },
+	}
+	if _, err := skylark.ExecFile(thread, "print.sky", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("output was %q, want empty", buf)
+	}
+	if got, want := strings.Join(printed, ";"), "hello;ab;1"; got != want {
+		t.Errorf("printed %q, want %q", got, want)
+	}
+
+	// Write errors are reported by print.
+	thread = &skylark.Thread{Output: errWriter{}}
+	_, err := skylark.ExecFile(thread, "print.sky", `print("x")`, nil)
+	if want := "print: disk full"; err == nil || err.(*skylark.EvalError).Msg != want {
+		t.Errorf("print to failing writer: got error %v, want %q", err, want)
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, fmt.Errorf("disk full") }
+
+// label is a user-defined value with distinct str and repr forms.
+type label string
+
+var _ skylark.HasStr = label("")
+
+func (l label) String() string      { return fmt.Sprintf("Label(%q)", string(l)) }
+func (l label) SkylarkStr() string  { return string(l) }
+func (label) Type() string          { return "label" }
+func (label) Freeze()               {}
+func (label) Truth() skylark.Bool   { return true }
+func (label) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable") }
+
+func TestHasStr(t *testing.T) {
+	const src = `
+s = str(l)
+r = repr(l)
+p = "%s %r" % (l, l)
+f = "{} {!s} {!r}".format(l, l, l)
+e = str([l])
+print(l, k=l)
+`
+	buf := new(bytes.Buffer)
+	thread := &skylark.Thread{Output: buf}
+	predeclared := skylark.StringDict{"l": label("//foo:bar")}
+	globals, err := skylark.ExecFile(thread, "hasstr.sky", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ name, want string }{
+		{"s", `//foo:bar`},
+		{"r", `Label("//foo:bar")`},
+		{"p", `//foo:bar Label("//foo:bar")`},
+		{"f", `//foo:bar //foo:bar Label("//foo:bar")`},
+		{"e", `[Label("//foo:bar")]`}, // elements use repr
+	} {
+		if got, _ := skylark.AsString(globals[test.name]); got != test.want {
+			t.Errorf("%s = %q, want %q", test.name, got, test.want)
+		}
+	}
+	if got, want := buf.String(), "//foo:bar k=//foo:bar\n"; got != want {
+		t.Errorf("print output was %q, want %q", got, want)
+	}
+}
+
+// TestThreadLocals checks that built-ins can use thread-local values to
+// accumulate state across calls within an evaluation.
+func TestThreadLocals(t *testing.T) {
+	// add(x) adds x to the thread's running total and returns it.
+	add := func(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var x int
+		if err := skylark.UnpackPositionalArgs("add", args, kwargs, 1, &x); err != nil {
+			return nil, err
+		}
+		total, _ := thread.Local("total").(int)
+		total += x
+		thread.SetLocal("total", total)
+		return skylark.MakeInt(total), nil
+	}
+	predeclared := skylark.StringDict{"add": skylark.NewBuiltin("add", add)}
+	const src = `
+add(1)
+add(2)
+x = add(3)
+`
+	thread1, thread2 := new(skylark.Thread), new(skylark.Thread)
+	thread2.SetLocal("total", 100) // set before execution
+	for _, test := range []struct {
+		thread *skylark.Thread
+		want   string
+	}{
+		{thread1, "6"},
+		{thread1, "12"}, // state persists across evaluations in one thread
+		{thread2, "106"},
+	} {
+		globals, err := skylark.ExecFile(test.thread, "locals.sky", src, predeclared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := globals["x"].String(); got != test.want {
+			t.Errorf("x = %s, want %s", got, test.want)
+		}
+	}
+	if got := new(skylark.Thread).Local("total"); got != nil {
+		t.Errorf("Local of new thread = %v, want nil", got)
+	}
+}
+
+// TestDictSetOrder tests the ordered comparison of dicts and sets
+// enabled by Thread.SetDictSetOrder.
+func TestDictSetOrder(t *testing.T) {
+	const src = `
+load("assert.sky", "assert")
+
+# dicts compare as lists of items in key order.
+assert.true({"a": 1} < {"a": 2})
+assert.true({"a": 1, "b": 0} > {"b": 0, "a": 0}) # insertion order is irrelevant
+assert.true({"a": 9} < {"b": 0})
+assert.true({"a": 1} < {"a": 1, "b": 0})
+assert.true({} < {"a": 1})
+assert.true({"a": 1, "b": 2} <= {"b": 2, "a": 1})
+assert.true({"a": 1, "b": 2} >= {"b": 2, "a": 1})
+assert.fails(lambda: {1: 0} < {"a": 0}, "int < string not implemented")
+assert.fails(lambda: {"a": []} < {"a": 1}, "list < int not implemented")
+
+# sets compare as lists of elements in order.
+assert.true(set([1, 2]) < set([1, 3]))
+assert.true(set([3, 1]) > set([1, 2, 3]))
+assert.true(set([2, 1]) <= set([1, 2]))
+assert.true(set() < set([0]))
+assert.fails(lambda: set([1, "a"]) < set([1]), "string < int not implemented")
+
+# Sorting a list of dicts is stable.
+ds = [{"k": 2, "v": 0}, {"k": 1, "v": 0}, {"v": 0, "k": 2}, {"k": 0, "v": 0}]
+assert.eq([d["k"] for d in sorted(ds)], [0, 1, 2, 2])
+assert.eq([d.keys() for d in sorted(ds)][2:], [["k", "v"], ["v", "k"]])
+assert.eq([d.keys() for d in sorted(ds, reverse=True)][:2], [["k", "v"], ["v", "k"]])
+assert.eq(sorted([set([2]), set([1, 3]), set([1])]), [set([1]), set([1, 3]), set([2])])
+assert.eq(min([{"a": 2}, {"a": 1}]), {"a": 1})
+assert.eq(max(set([1]), set([0, 2])), set([1]))
+
+# The order applies to nested dicts and sets.
+assert.true([{"a": 1}] < [{"a": 2}])
+assert.true(({"a": 1}, 0) < ({"a": 1}, 1))
+assert.true({"k": {"a": 1}} < {"k": {"a": 2}})
+assert.eq(sorted([(1, {"a": 2}), (1, {"a": 1})]), [(1, {"a": 1}), (1, {"a": 2})])
+`
+	thread := &skylark.Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	thread.SetDictSetOrder(true)
+	if _, err := skylark.ExecFile(thread, "order.sky", src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The option belongs to the thread, so another thread,
+	// or the same one after disabling it, is unaffected.
+	thread2 := new(skylark.Thread)
+	thread.SetDictSetOrder(false)
+	for _, thread := range []*skylark.Thread{thread2, thread} {
+		for _, src := range []string{`{} < {}`, `sorted([{}, {}])`, `[{}] < [{"a": 1}]`} {
+			_, err := skylark.ExecFile(thread, "order.sky", src, nil)
+			if want := "dict < dict not implemented"; err == nil || err.(*skylark.EvalError).Msg != want {
+				t.Errorf("%s with option off: got error %v, want %q", src, err, want)
+			}
+		}
+	}
+
+	// Compare itself never orders dicts.
+	if _, err := skylark.Compare(syntax.LT, new(skylark.Dict), new(skylark.Dict)); err == nil {
+		t.Errorf("Compare(dict < dict) succeeded unexpectedly")
+	}
+}
+
+// TestDictViews tests the views returned by the dict keys, values,
+// and items methods when enabled by Thread.SetDictViews.
+func TestDictViews(t *testing.T) {
+	const src = `
+load("assert.sky", "assert")
+d = {"a": 1, "b": 2}
+assert.eq(type(d.keys()), "dict_keys")
+assert.eq(type(d.values()), "dict_values")
+assert.eq(type(d.items()), "dict_items")
+assert.eq(str(d.items()), 'dict_items([("a", 1), ("b", 2)])')
+assert.eq(list(d.keys()), ["a", "b"])
+assert.eq(sorted(d.values()), [1, 2])
+assert.eq(len(d.items()), 2)
+assert.true("a" in d.keys())
+assert.true(("b", 2) in d.items())
+def sum_items():
+    total = 0
+    for k, v in d.items():
+        total += v
+    return total
+assert.eq(sum_items(), 3)
+def mutate():
+    for k in d.keys():
+        d.pop(k)
+assert.fails(mutate, "cannot delete from hash table during iteration")
+assert.fails(lambda: d.keys()[0], "unhandled index operation dict_keys\\[int\\]")
+`
+	thread := &skylark.Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	thread.SetDictViews(true)
+	if _, err := skylark.ExecFile(thread, "views.sky", src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The option belongs to the thread.
+	for _, thread := range []*skylark.Thread{new(skylark.Thread), thread} {
+		thread.SetDictViews(false)
+		v, err := skylark.Eval(thread, "<expr>", `type({}.items())`, nil)
+		if err != nil || v != skylark.String("list") {
+			t.Errorf("type({}.items()) with views off = %v, %v, want list", v, err)
+		}
+	}
+
+	// 'in' on a values view does not copy the entries.
+	d := new(skylark.Dict)
+	for i := 0; i < 1000; i++ {
+		d.SetKey(skylark.MakeInt(i), skylark.MakeInt(i))
+	}
+	values, err := skylark.Eval(thread, "<expr>", `d.itervalues()`, skylark.StringDict{"d": d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := skylark.MakeInt(999)
+	allocs := testing.AllocsPerRun(10, func() {
+		if ok, err := skylark.Binary(syntax.IN, x, values); ok != skylark.True || err != nil {
+			t.Fatalf("999 in d.itervalues() = %v, %v", ok, err)
+		}
+	})
+	if allocs > 2 {
+		t.Errorf("999 in d.itervalues() made %v allocations, want at most 2", allocs)
+	}
+}
+
+// BenchmarkDictItems measures iteration over d.items() for a large
+// dict, with and without Thread.SetDictViews.
+func BenchmarkDictItems(b *testing.B) {
+	d := new(skylark.Dict)
+	for i := 0; i < 1000000; i++ {
+		d.SetKey(skylark.MakeInt(i), skylark.MakeInt(i))
+	}
+	const src = `
+def count(d):
+    n = 0
+    for k, v in d.items():
+        n += 1
+    return n
+`
+	globals, err := skylark.ExecFile(new(skylark.Thread), "items.sky", src, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, views := range []bool{false, true} {
+		b.Run(fmt.Sprintf("views=%t", views), func(b *testing.B) {
+			thread := new(skylark.Thread)
+			thread.SetDictViews(views)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := skylark.Call(thread, globals["count"], skylark.Tuple{d}, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestMaxFormatSize checks that formatting fails promptly, rather than
+// exhausting memory, when the result would exceed the limit set by
+// SetMaxFormatSize.
+func TestMaxFormatSize(t *testing.T) {
+	for _, test := range []struct {
+		src, want string
+	}{
+		// Each would produce a 1GB string.
+		{`("{0}" * 10000).format("x" * 100000)`, "formatted string too large"},
+		{`("%s" * 10000) % tuple(["x" * 100000] * 10000)`, "formatted string too large"},
+		{`("%(k)s" * 10000) % {"k": "x" * 100000}`, "formatted string too large"},
+		// A literal tail that crosses the limit is also rejected.
+		{`len(("{}" + "y" * (1 << 20)).format("x"))`, "formatted string too large"},
+		// Results within the limit are unaffected.
+		{`len(("{0}" * 10).format("x" * 100000))`, "1000000"},
+		{`len(("%s" * 10) % tuple(["x" * 100000] * 10))`, "1000000"},
+	} {
+		thread := new(skylark.Thread)
+		thread.SetMaxFormatSize(1 << 20)
+		var got string
+		if v, err := skylark.Eval(thread, "<expr>", test.src, nil); err != nil {
+			got = err.(*skylark.EvalError).Msg
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+
+	// The limit is per thread; zero, the default, means no limit.
+	if _, err := skylark.Eval(new(skylark.Thread), "<expr>", `("{0}" * 30).format("x" * 100000)`, nil); err != nil {
+		t.Errorf("with no limit: %v", err)
+	}
+	thread := new(skylark.Thread)
+	thread.SetMaxFormatSize(10)
+	thread.SetMaxFormatSize(0)
+	if _, err := skylark.Eval(thread, "<expr>", `"%s" % ("x" * 100)`, nil); err != nil {
+		t.Errorf("with limit removed: %v", err)
+	}
+}
+
 func Benchmark(b *testing.B) {
 	testdata := skylarktest.DataFile("skylark", ".")
 	thread := new(skylark.Thread)
@@ -446,6 +905,58 @@ Error: floored division by zero`
 	}
 }
 
+// TestPredicateBacktrace ensures that the error from a failed
+// predicate of all or any reports the element and keeps the
+// backtrace of the predicate.
+func TestPredicateBacktrace(t *testing.T) {
+	const src = `
+def f(x): return 1//x
+all([1, 0], f)
+`
+	thread := new(skylark.Thread)
+	_, err := skylark.ExecFile(thread, "pred.sky", src, nil)
+	evalErr, ok := err.(*skylark.EvalError)
+	if !ok {
+		t.Fatalf("ExecFile failed with %v, wanted *EvalError", err)
+	}
+	const want = `Traceback (most recent call last):
+  pred.sky:3: in <toplevel>
+  <builtin>:1: in all
+  pred.sky:2: in f
+Error: all: predicate failed for element 1: floored division by zero`
+	if got := evalErr.Backtrace(); got != want {
+		t.Errorf("error was %s, want %s", got, want)
+	}
+}
+
+// TestFailBacktrace ensures that the error from a call to fail
+// includes the stack of active calls, ending at the call site of fail.
+func TestFailBacktrace(t *testing.T) {
+	const src = `
+def check(x):
+	if x < 0:
+		fail("invalid x:", x)
+check(-1)
+`
+	thread := new(skylark.Thread)
+	_, err := skylark.ExecFile(thread, "fail.sky", src, nil)
+	switch err := err.(type) {
+	case *skylark.EvalError:
+		got := err.Backtrace()
+		const want = `Traceback (most recent call last):
+  fail.sky:5: in <toplevel>
+  fail.sky:4: in check
+Error: fail: invalid x: -1`
+		if got != want {
+			t.Errorf("error was %s, want %s", got, want)
+		}
+	case nil:
+		t.Error("ExecFile succeeded unexpectedly")
+	default:
+		t.Errorf("ExecFile failed with %v, wanted *EvalError", err)
+	}
+}
+
 // TestRepeatedExec parses and resolves a file syntax tree once then
 // executes it repeatedly with different values of its predeclared variables.
 func TestRepeatedExec(t *testing.T) {
@@ -493,3 +1004,1163 @@ func TestUnpackUserDefined(t *testing.T) {
 		t.Errorf("unpack args error = %q, want %q", err, want)
 	}
 }
+
+func TestUnpackNumbers(t *testing.T) {
+	unpack := func(arg skylark.Value, ptr interface{}) string {
+		err := skylark.UnpackArgs("unpack", skylark.Tuple{arg}, nil, "x", ptr)
+		if err != nil {
+			return strings.TrimPrefix(err.Error(), "unpack: for parameter 1: ")
+		}
+		switch ptr := ptr.(type) {
+		case *skylark.Int:
+			return ptr.String()
+		case *skylark.Float:
+			return ptr.String()
+		case *float64:
+			return fmt.Sprint(*ptr)
+		case *int64:
+			return fmt.Sprint(*ptr)
+		}
+		panic(ptr)
+	}
+	for _, test := range []struct {
+		arg                skylark.Value
+		wantInt, wantFloat string
+		wantFloat64        string
+		wantInt64          string
+	}{
+		{skylark.MakeInt(3), "3", "3.0", "3", "3"},
+		{skylark.Float(2.5), "got float, want int", "2.5", "2.5", "got float, want int"},
+		{skylark.True, "got bool, want int", "1.0", "1", "got bool, want int"},
+		{skylark.String("1"), "got string, want int", "got string, want float", "got string, want float", "got string, want int"},
+		{skylark.MakeInt(1).Lsh(2000), "", "+inf", "int too large to convert to float", ""},
+		{skylark.Float(math.Inf(-1)), "got float, want int", "-inf", "got -inf, want finite float", "got float, want int"},
+		{skylark.Float(math.NaN()), "got float, want int", "nan", "got nan, want finite float", "got float, want int"},
+		{skylark.MakeInt64(math.MinInt64), "", "-9.223372036854776e+18", "-9.223372036854776e+18", "-9223372036854775808"},
+		{skylark.MakeUint64(math.MaxInt64 + 1), "", "9.223372036854776e+18", "9.223372036854776e+18", ""},
+	} {
+		var i skylark.Int
+		var f skylark.Float
+		var f64 float64
+		var i64 int64
+		if test.wantInt == "" {
+			test.wantInt = test.arg.String()
+		}
+		if test.wantInt64 == "" {
+			test.wantInt64 = test.arg.String() + " out of range"
+		}
+		if got := unpack(test.arg, &i); got != test.wantInt {
+			t.Errorf("unpack %s into Int: got %s, want %s", test.arg, got, test.wantInt)
+		}
+		if got := unpack(test.arg, &i64); got != test.wantInt64 {
+			t.Errorf("unpack %s into int64: got %s, want %s", test.arg, got, test.wantInt64)
+		}
+		if got := unpack(test.arg, &f); got != test.wantFloat {
+			t.Errorf("unpack %s into Float: got %s, want %s", test.arg, got, test.wantFloat)
+		}
+		if got := unpack(test.arg, &f64); got != test.wantFloat64 {
+			t.Errorf("unpack %s into float64: got %s, want %s", test.arg, got, test.wantFloat64)
+		}
+	}
+}
+
+func TestUnpackSetAndTuple(t *testing.T) {
+	set := new(skylark.Set)
+	set.Insert(skylark.MakeInt(1))
+	tuple := skylark.Tuple{skylark.MakeInt(1), skylark.MakeInt(2)}
+
+	var s *skylark.Set
+	var tup skylark.Tuple
+	if err := skylark.UnpackArgs("unpack", skylark.Tuple{set, tuple}, nil, "s", &s, "t", &tup); err != nil {
+		t.Fatal(err)
+	}
+	if s != set {
+		t.Errorf("set = %v, want %v", s, set)
+	}
+	if got := tup.String(); got != "(1, 2)" {
+		t.Errorf("tuple = %s, want (1, 2)", got)
+	}
+
+	err := skylark.UnpackArgs("unpack", skylark.Tuple{tuple}, nil, "s", &s)
+	if want := "unpack: for parameter 1: got tuple, want set"; fmt.Sprint(err) != want {
+		t.Errorf("unpack tuple into set: error = %q, want %q", err, want)
+	}
+	err = skylark.UnpackArgs("unpack", skylark.Tuple{set}, nil, "t", &tup)
+	if want := "unpack: for parameter 1: got set, want tuple"; fmt.Sprint(err) != want {
+		t.Errorf("unpack set into tuple: error = %q, want %q", err, want)
+	}
+}
+
+// TestUnpackOmittedVersusNone ensures that an optional Value parameter
+// distinguishes an omitted argument (nil) from an explicit None.
+func TestUnpackOmittedVersusNone(t *testing.T) {
+	for _, test := range []struct {
+		args   skylark.Tuple
+		kwargs []skylark.Tuple
+		want   skylark.Value
+	}{
+		{nil, nil, nil},
+		{skylark.Tuple{skylark.None}, nil, skylark.None},
+		{nil, []skylark.Tuple{{skylark.String("x"), skylark.None}}, skylark.None},
+		{skylark.Tuple{skylark.True}, nil, skylark.True},
+	} {
+		var x skylark.Value
+		if err := skylark.UnpackArgs("unpack", test.args, test.kwargs, "x?", &x); err != nil {
+			t.Fatal(err)
+		}
+		if x != test.want {
+			t.Errorf("unpack %v %v: got %v, want %v", test.args, test.kwargs, x, test.want)
+		}
+	}
+}
+
+func TestUnpackVarargs(t *testing.T) {
+	one, two, three := skylark.MakeInt(1), skylark.MakeInt(2), skylark.MakeInt(3)
+	kw := func(name string, v skylark.Value) skylark.Tuple { return skylark.Tuple{skylark.String(name), v} }
+
+	for _, test := range []struct {
+		args   skylark.Tuple
+		kwargs []skylark.Tuple
+		want   string
+	}{
+		{skylark.Tuple{one}, nil, "a=1 args=() b=0 kwargs=[]"},
+		{skylark.Tuple{one, two, three}, nil, "a=1 args=(2, 3) b=0 kwargs=[]"},
+		{skylark.Tuple{one, two}, []skylark.Tuple{kw("b", three)}, "a=1 args=(2,) b=3 kwargs=[]"},
+		{nil, []skylark.Tuple{kw("a", one), kw("c", two), kw("d", three)}, `a=1 args=() b=0 kwargs=[("c", 2) ("d", 3)]`},
+		{nil, nil, "unpack: missing argument for a"},
+		{skylark.Tuple{one}, []skylark.Tuple{kw("a", two)}, `unpack: got multiple values for keyword argument "a"`},
+	} {
+		var a, b int
+		var args skylark.Tuple
+		var kwargs []skylark.Tuple
+		var got string
+		if err := skylark.UnpackArgs("unpack", test.args, test.kwargs,
+			"a", &a, "*args", &args, "b?", &b, "**kwargs", &kwargs); err != nil {
+			got = err.Error()
+		} else {
+			got = fmt.Sprintf("a=%d args=%s b=%d kwargs=%v", a, args, b, kwargs)
+		}
+		if got != test.want {
+			t.Errorf("unpack %v %v: got %s, want %s", test.args, test.kwargs, got, test.want)
+		}
+	}
+
+	// Without *args, surplus positional arguments are an error;
+	// **kwargs may be a StringDict.
+	var x skylark.Value
+	var kwdict skylark.StringDict
+	err := skylark.UnpackArgs("unpack", skylark.Tuple{one, two}, nil, "x", &x, "**kwargs", &kwdict)
+	if want := "unpack: got 2 arguments, want at most 1"; fmt.Sprint(err) != want {
+		t.Errorf("unpack surplus args: error = %q, want %q", err, want)
+	}
+	err = skylark.UnpackArgs("unpack", nil, []skylark.Tuple{kw("x", one), kw("y", two)}, "x", &x, "**kwargs", &kwdict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := kwdict.String(); got != "{y: 2}" {
+		t.Errorf("kwargs = %s, want {y: 2}", got)
+	}
+}
+
+func TestUnpackKeywordOnly(t *testing.T) {
+	one, two, three := skylark.MakeInt(1), skylark.MakeInt(2), skylark.MakeInt(3)
+	kw := func(name string, v skylark.Value) skylark.Tuple { return skylark.Tuple{skylark.String(name), v} }
+
+	for _, test := range []struct {
+		args   skylark.Tuple
+		kwargs []skylark.Tuple
+		want   string
+	}{
+		{skylark.Tuple{one}, []skylark.Tuple{kw("b", two)}, "a=1 b=2 c=0"},
+		{nil, []skylark.Tuple{kw("a", one), kw("b", two), kw("c", three)}, "a=1 b=2 c=3"},
+		{skylark.Tuple{one, two}, nil, "unpack: got 2 positional arguments, want at most 1 (b is keyword-only)"},
+		{skylark.Tuple{one, two, three}, nil, "unpack: got 3 positional arguments, want at most 1 (b is keyword-only)"},
+		{skylark.Tuple{one}, nil, "unpack: missing argument for b"},
+		{skylark.Tuple{one}, []skylark.Tuple{kw("b", two), kw("d", three)}, `unpack: unexpected keyword argument "d"`},
+	} {
+		var a, b, c int
+		var got string
+		if err := skylark.UnpackArgs("unpack", test.args, test.kwargs,
+			"a", &a, "*", nil, "b", &b, "c?", &c); err != nil {
+			got = err.Error()
+		} else {
+			got = fmt.Sprintf("a=%d b=%d c=%d", a, b, c)
+		}
+		if got != test.want {
+			t.Errorf("unpack %v %v: got %s, want %s", test.args, test.kwargs, got, test.want)
+		}
+	}
+
+	// An optional keyword-only parameter is named without its "?".
+	var x skylark.Value
+	var y bool
+	err := skylark.UnpackArgs("unpack", skylark.Tuple{one, skylark.True}, nil, "x", &x, "*", nil, "y?", &y)
+	if want := "unpack: got 2 positional arguments, want at most 1 (y is keyword-only)"; fmt.Sprint(err) != want {
+		t.Errorf("unpack keyword-only: error = %q, want %q", err, want)
+	}
+}
+
+func TestUnpackDefaults(t *testing.T) {
+	one, two := skylark.MakeInt(1), skylark.MakeInt(2)
+	kw := func(name string, v skylark.Value) skylark.Tuple { return skylark.Tuple{skylark.String(name), v} }
+
+	for _, test := range []struct {
+		args   skylark.Tuple
+		kwargs []skylark.Tuple
+		want   string
+	}{
+		{skylark.Tuple{one}, nil, "a=1 b=10 c=None s=dflt"},
+		{skylark.Tuple{one, two}, nil, "a=1 b=2 c=None s=dflt"},
+		{skylark.Tuple{one}, []skylark.Tuple{kw("c", two)}, "a=1 b=10 c=2 s=dflt"},
+		{nil, []skylark.Tuple{kw("a", one), kw("s", skylark.String("x"))}, "a=1 b=10 c=None s=x"},
+		{skylark.Tuple{one, skylark.None}, nil, "unpack: for parameter 2: got NoneType, want int"},
+		{skylark.Tuple{one, two}, []skylark.Tuple{kw("b", one)}, `unpack: got multiple values for keyword argument "b"`},
+		{nil, []skylark.Tuple{kw("b", one)}, "unpack: missing argument for a"},
+	} {
+		a, b, s := 0, -1, "garbage"
+		var c skylark.Value = skylark.True
+		var got string
+		if err := skylark.UnpackArgs("unpack", test.args, test.kwargs,
+			"a", &a,
+			"b?", skylark.Default(&b, 10),
+			"c?", skylark.Default(&c, skylark.None),
+			"s?", skylark.Default(&s, "dflt")); err != nil {
+			got = err.Error()
+		} else {
+			got = fmt.Sprintf("a=%d b=%d c=%s s=%s", a, b, c, s)
+		}
+		if got != test.want {
+			t.Errorf("unpack %v %v: got %s, want %s", test.args, test.kwargs, got, test.want)
+		}
+	}
+
+	// UnpackPositionalArgs
+	var x, y int
+	if err := skylark.UnpackPositionalArgs("unpack", skylark.Tuple{one}, nil, 1, &x, skylark.Default(&y, 7)); err != nil {
+		t.Fatal(err)
+	}
+	if x != 1 || y != 7 {
+		t.Errorf("unpack positional: got %d, %d, want 1, 7", x, y)
+	}
+}
+
+func TestBuiltinSignature(t *testing.T) {
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"len", "x"},
+		{"sorted", "iterable, *, key?, reverse?"},
+		{"stack_depth", ""},
+		{"print", "*args, sep?, end?, **kwargs"},
+	} {
+		b := skylark.Universe[test.name].(*skylark.Builtin)
+		if got := strings.Join(b.Signature(), ", "); got != test.want {
+			t.Errorf("%s.Signature() = %q, want %q", test.name, got, test.want)
+		}
+		if b.Signature() == nil {
+			t.Errorf("%s.Signature() = nil, want non-nil", test.name)
+		}
+	}
+
+	// Bound methods inherit the signature; others have none.
+	f := skylark.NewBuiltin("f", nil).WithSignature("a", "b?")
+	if got := f.BindReceiver(skylark.None).Signature(); len(got) != 2 {
+		t.Errorf("bound method signature = %q, want 2 params", got)
+	}
+	if got := skylark.NewBuiltin("g", nil).Signature(); got != nil {
+		t.Errorf("g.Signature() = %q, want nil", got)
+	}
+}
+
+// TestMemoizePerThread ensures that memoize caches results per thread.
+func TestMemoizePerThread(t *testing.T) {
+	calls := 0
+	count := skylark.NewBuiltin("count", func(_ *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		calls++
+		return skylark.MakeInt(calls), nil
+	})
+	globals, err := skylark.ExecFile(new(skylark.Thread), "memo.sky", "f = memoize(count)", skylark.StringDict{"count": count})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := globals["f"]
+	for i, thread := range []*skylark.Thread{new(skylark.Thread), new(skylark.Thread)} {
+		thread.SetLocal("memoize", "client value")
+		for j := 0; j < 2; j++ {
+			v, err := skylark.Call(thread, f, skylark.Tuple{skylark.String("x")}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := v.String(), fmt.Sprint(i+1); got != want {
+				t.Errorf("thread %d, call %d: got %s, want %s", i, j, got, want)
+			}
+		}
+		// The caches do not use the client's thread-local storage.
+		if got, want := thread.Local("memoize"), "client value"; got != want {
+			t.Errorf("thread %d: Local(\"memoize\") = %v, want %q", i, got, want)
+		}
+	}
+}
+
+// TestExecFilePartialGlobals ensures that ExecFile returns the globals
+// defined before a failure, along with the error.
+func TestExecFilePartialGlobals(t *testing.T) {
+	const src = `
+a = 1
+b = [a, 2]
+c = b[5]
+d = 4
+`
+	globals, err := skylark.ExecFile(new(skylark.Thread), "partial.sky", src, nil)
+	if err == nil {
+		t.Fatal("ExecFile succeeded unexpectedly")
+	}
+	if _, ok := err.(*skylark.EvalError); !ok {
+		t.Fatalf("ExecFile failed with %v, wanted *EvalError", err)
+	}
+	if got, want := globals.String(), "{a: 1, b: [1, 2]}"; got != want {
+		t.Errorf("partial globals = %s, want %s", got, want)
+	}
+	// The partial globals are frozen, as on success.
+	if err := globals["b"].(*skylark.List).Append(skylark.None); err == nil {
+		t.Error("append to partial global succeeded, want frozen error")
+	}
+}
+
+// tryInsert is the try_insert built-in used by TestEnvBuiltins.
+// It reports the error from inserting into a dict.
+func tryInsert(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	err := args[0].(*skylark.Dict).SetKey(skylark.String("z"), skylark.None)
+	return skylark.String(fmt.Sprint(err)), nil
+}
+
+// TestEnvBuiltins tests the globals() and predeclared() built-ins.
+func TestEnvBuiltins(t *testing.T) {
+	for _, test := range []struct {
+		filename    string
+		src         string
+		predeclared skylark.StringDict
+		want        map[string]string // global name -> String() of its value
+		check       func(t *testing.T, globals, predeclared skylark.StringDict)
+	}{
+		{
+			filename: "globals.sky",
+			src: `
+a = 1
+top = globals()
+b = [a]
+def f():
+    local = 1
+    return globals()
+inner = f()
+top_keys = list(top)
+inner_keys = list(inner)
+inner["b"].append(2) # values are shared with the module
+insert_error = try_insert(top)
+`,
+			want: map[string]string{
+				// At top level, only the globals defined so far are visible.
+				"top_keys": `["a"]`,
+				// Within a function, the module's globals are visible, not its locals.
+				"inner_keys": `["a", "top", "b", "f"]`,
+				"b":          "[1, 2]",
+				// The result is a read-only snapshot.
+				"insert_error": `"cannot insert into frozen hash table"`,
+			},
+		},
+		{
+			filename: "predeclared.sky",
+			src: `
+env = predeclared()
+has_host = "host" in env and env["host"] == host
+has_len = "len" in env and env["len"] == len
+has_global = "x" in env
+x = 1
+shadowed = env["print"]
+host.append(1) # values are not frozen
+insert_error = try_insert(env)
+`,
+			predeclared: skylark.StringDict{
+				"host":  skylark.NewList(nil),
+				"print": skylark.String("not the built-in print"),
+			},
+			want: map[string]string{
+				"has_host":     "True",
+				"has_len":      "True",
+				"has_global":   "False",
+				"shadowed":     `"not the built-in print"`, // module names shadow universal ones
+				"insert_error": `"cannot insert into frozen hash table"`,
+			},
+			check: func(t *testing.T, globals, predeclared skylark.StringDict) {
+				if got, want := predeclared["host"].String(), "[1]"; got != want {
+					t.Errorf("host = %s, want %s", got, want)
+				}
+				// Names are sorted.
+				keys := globals["env"].(*skylark.Dict).Keys()
+				for i := 1; i < len(keys); i++ {
+					if keys[i-1].(skylark.String) >= keys[i].(skylark.String) {
+						t.Errorf("predeclared() keys not sorted: %s before %s", keys[i-1], keys[i])
+					}
+				}
+			},
+		},
+	} {
+		predeclared := skylark.StringDict{
+			"try_insert": skylark.NewBuiltin("try_insert", tryInsert),
+		}
+		for name, v := range test.predeclared {
+			predeclared[name] = v
+		}
+		globals, err := skylark.ExecFile(new(skylark.Thread), test.filename, test.src, predeclared)
+		if err != nil {
+			t.Errorf("%s: %v", test.filename, err)
+			continue
+		}
+		for name, want := range test.want {
+			if got := globals[name].String(); got != want {
+				t.Errorf("%s: %s = %s, want %s", test.filename, name, got, want)
+			}
+		}
+		if test.check != nil {
+			test.check(t, globals, predeclared)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	// count(n) returns a generator of the integers 0 to n-1.
+	var started, done int
+	count := func(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var n int
+		if err := skylark.UnpackPositionalArgs("count", args, kwargs, 1, &n); err != nil {
+			return nil, err
+		}
+		return skylark.NewGenerator("count", func() (func() (skylark.Value, bool), func()) {
+			started++
+			i := 0
+			next := func() (skylark.Value, bool) {
+				if i == n {
+					return nil, false
+				}
+				i++
+				return skylark.MakeInt(i - 1), true
+			}
+			return next, func() { done++ }
+		}), nil
+	}
+	const src = `
+g = count(5)
+elems = list(g)
+again = list(g)
+def first_two():
+    result = []
+    for x in g:
+        if x == 2:
+            break
+        result.append(x)
+    return result
+prefix = first_two()
+empty = list(count(0))
+`
+	predeclared := skylark.StringDict{
+		"count": skylark.NewBuiltin("count", count),
+	}
+	globals, err := skylark.ExecFile(new(skylark.Thread), "generator.sky", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct{ name, want string }{
+		{"g", "<generator count>"},
+		{"elems", "[0, 1, 2, 3, 4]"},
+		{"again", "[0, 1, 2, 3, 4]"},
+		{"prefix", "[0, 1]"},
+		{"empty", "[]"},
+	} {
+		if got := globals[test.name].String(); got != test.want {
+			t.Errorf("%s = %s, want %s", test.name, got, test.want)
+		}
+	}
+	// Every iteration, including the one that stopped early, was released.
+	if started != 4 || done != 4 {
+		t.Errorf("started %d iterations and released %d, want 4 and 4", started, done)
+	}
+}
+
+// TestFailableGenerator checks that an error from a generator ends the
+// iteration and is reported by the operation that consumed it.
+func TestFailableGenerator(t *testing.T) {
+	// upto(n) returns a generator of the integers 0 to n-1, then fails.
+	var done int
+	upto := func(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var n int
+		if err := skylark.UnpackPositionalArgs("upto", args, kwargs, 1, &n); err != nil {
+			return nil, err
+		}
+		return skylark.NewFailableGenerator("upto", func(*skylark.Thread) (func() (skylark.Value, bool, error), func()) {
+			i := 0
+			next := func() (skylark.Value, bool, error) {
+				if i == n {
+					return nil, false, fmt.Errorf("upto: reached %d", n)
+				}
+				i++
+				return skylark.MakeInt(i - 1), true, nil
+			}
+			return next, func() { done++ }
+		}), nil
+	}
+	predeclared := skylark.StringDict{
+		"upto": skylark.NewBuiltin("upto", upto),
+	}
+	for _, src := range []string{
+		`list(upto(3))`,
+		`sorted(upto(3))`,
+		`[x for x in upto(3)]`,
+		`{x: x for x in upto(3)}`,
+		`",".join([str(x) for x in upto(3)])`,
+	} {
+		_, err := skylark.Eval(new(skylark.Thread), "<expr>", src, predeclared)
+		if want := "upto: reached 3"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", src, err, want)
+		}
+	}
+	if done != 5 {
+		t.Errorf("released %d iterations, want 5", done)
+	}
+
+	// A short-circuiting consumer never sees the error.
+	v, err := skylark.Eval(new(skylark.Thread), "<expr>", `any(upto(3))`, predeclared)
+	if err != nil || v != skylark.True {
+		t.Errorf("any(upto(3)) = %v, %v, want True", v, err)
+	}
+}
+
+// TestMapIteratingThread checks that the function applied by a lazy
+// map or filter is called by the thread that iterates over the result,
+// not the thread that created it.
+func TestMapIteratingThread(t *testing.T) {
+	const src = `
+def f(x):
+    print(x)
+    return x
+m = map(f, [1, 2])
+p = filter(f, [3, 4])
+`
+	var creator []string
+	thread := &skylark.Thread{
+		Print: func(_ *skylark.Thread, msg string) { creator = append(creator, msg) },
+	}
+	globals, err := skylark.ExecFile(thread, "map.sky", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globals.Freeze()
+
+	for _, expr := range []string{"list(m)", "[x for x in p]"} {
+		var iterator []string
+		thread2 := &skylark.Thread{
+			Print: func(_ *skylark.Thread, msg string) { iterator = append(iterator, msg) },
+		}
+		if _, err := skylark.Eval(thread2, "<expr>", expr, globals); err != nil {
+			t.Fatalf("%s: %v", expr, err)
+		}
+		if len(iterator) != 2 {
+			t.Errorf("%s: iterating thread printed %q, want 2 lines", expr, iterator)
+		}
+	}
+	if creator != nil {
+		t.Errorf("creating thread printed %q, want nothing", creator)
+	}
+
+	// Without a thread, the iteration fails rather than borrowing one.
+	iter := globals["m"].(skylark.Iterable).Iterate()
+	defer iter.Done()
+	var x skylark.Value
+	if iter.Next(&x) {
+		t.Errorf("Iterate() without a thread yielded %v", x)
+	}
+	if err := skylark.IterErr(iter); err == nil || err.Error() != "map: cannot iterate without a thread" {
+		t.Errorf("Iterate() without a thread: got error %v", err)
+	}
+}
+
+// brokenIterable is an application-defined Iterable whose iterator
+// yields the integers 0 to n-1 and then fails.
+type brokenIterable int
+
+func (b brokenIterable) Freeze()                   {}
+func (b brokenIterable) String() string            { return "broken" }
+func (b brokenIterable) Type() string              { return "broken" }
+func (b brokenIterable) Truth() skylark.Bool       { return true }
+func (b brokenIterable) Hash() (uint32, error)     { return 0, fmt.Errorf("broken is unhashable") }
+func (b brokenIterable) Iterate() skylark.Iterator { return &brokenIterator{n: int(b)} }
+
+type brokenIterator struct {
+	i, n int
+	err  error
+}
+
+var _ skylark.FailableIterator = (*brokenIterator)(nil)
+
+func (it *brokenIterator) Next(p *skylark.Value) bool {
+	if it.i == it.n {
+		it.err = fmt.Errorf("broken after %d elements", it.n)
+	}
+	if it.err != nil {
+		return false
+	}
+	*p = skylark.MakeInt(it.i)
+	it.i++
+	return true
+}
+func (it *brokenIterator) Err() error { return it.err }
+func (it *brokenIterator) Done()      {}
+
+// TestFailableIterator checks that the error of an application-defined
+// FailableIterator is reported by each operation that consumes it.
+func TestFailableIterator(t *testing.T) {
+	predeclared := skylark.StringDict{"broken": brokenIterable(2)}
+	for _, src := range []string{
+		`list(broken)`,
+		`tuple(broken)`,
+		`sorted(broken)`,
+		`set(broken)`,
+		`dict([(x, x) for x in broken])`,
+		`enumerate(broken)`,
+		`zip(broken)`,
+		`reversed(broken)`,
+		`max(broken)`,
+		`len(*broken)`,
+		`[] + list(broken)`,
+		`[].extend(broken)`,
+		`{}.fromkeys(broken)`,
+		`list(map(str, broken))`,
+		`list(filter(None, broken))`,
+	} {
+		_, err := skylark.Eval(new(skylark.Thread), "<expr>", src, predeclared)
+		if want := "broken after 2 elements"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", src, err, want)
+		}
+	}
+
+	// for loops and sequence assignment
+	const src = `
+def loop():
+    for x in broken:
+        pass
+def unpack():
+    a, b = broken
+`
+	globals, err := skylark.ExecFile(new(skylark.Thread), "broken.sky", src, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"loop", "unpack"} {
+		_, err := skylark.Call(new(skylark.Thread), globals[name], nil, nil)
+		if want := "broken after 2 elements"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", name, err, want)
+		}
+	}
+
+	// An iterator that is not a FailableIterator never fails.
+	if err := skylark.IterErr(fib{}.Iterate()); err != nil {
+		t.Errorf("IterErr(fib) = %v", err)
+	}
+}
+
+// TestLenHint checks that built-ins that preallocate using an
+// estimated length produce correct results even when the estimate is wrong.
+func TestLenHint(t *testing.T) {
+	// count(n, hint) returns a generator of the integers 0 to n-1
+	// whose estimated length is hint.
+	count := func(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		var n int
+		var hint int64
+		if err := skylark.UnpackPositionalArgs("count", args, kwargs, 2, &n, &hint); err != nil {
+			return nil, err
+		}
+		return skylark.NewGenerator("count", func() (func() (skylark.Value, bool), func()) {
+			i := 0
+			next := func() (skylark.Value, bool) {
+				if i == n {
+					return nil, false
+				}
+				i++
+				return skylark.MakeInt(i - 1), true
+			}
+			return next, func() {}
+		}).WithLenHint(int(hint)), nil
+	}
+	predeclared := skylark.StringDict{
+		"count": skylark.NewBuiltin("count", count),
+	}
+	for _, hint := range []int{-1, 0, 1, 3, 100, 1 << 62} { // 1<<62 is wrong and huge
+		const src = `
+l = list(count(3, hint))
+t = tuple(count(3, hint))
+s = sorted(count(3, hint), reverse=True)
+r = reversed(count(3, hint))
+z = zip(count(3, hint), count(2, hint))
+`
+		predeclared["hint"] = skylark.MakeInt(hint)
+		globals, err := skylark.ExecFile(new(skylark.Thread), "lenhint.sky", src, predeclared)
+		if err != nil {
+			t.Fatalf("hint=%d: %v", hint, err)
+		}
+		for _, test := range []struct{ name, want string }{
+			{"l", "[0, 1, 2]"},
+			{"t", "(0, 1, 2)"},
+			{"s", "[2, 1, 0]"},
+			{"r", "[2, 1, 0]"},
+			{"z", "[(0, 0), (1, 1)]"},
+		} {
+			if got := globals[test.name].String(); got != test.want {
+				t.Errorf("hint=%d: %s = %s, want %s", hint, test.name, got, test.want)
+			}
+		}
+	}
+}
+
+// internWorkload builds many dicts whose keys are computed strings
+// drawn from a small set.
+const internWorkload = `
+dicts = []
+def build():
+    for i in range(2000):
+        d = {"key%d" % (i % 10): i}
+        d["attr%d" % (i % 7)] = i
+        dicts.append(d)
+build()
+`
+
+func TestInternKeys(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		thread := new(skylark.Thread)
+		thread.SetInternKeys(enabled)
+		globals, err := skylark.ExecFile(thread, "intern.sky", internWorkload, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dicts := globals["dicts"].(*skylark.List)
+		// dicts 0 and 70 have equal keys, computed separately.
+		d0, d70 := dicts.Index(0).(*skylark.Dict), dicts.Index(70).(*skylark.Dict)
+		if !reflect.DeepEqual(d0.Keys(), d70.Keys()) {
+			t.Fatalf("keys differ: %v, %v", d0.Keys(), d70.Keys())
+		}
+		for i, k0 := range d0.Keys() {
+			k70 := d70.Keys()[i]
+			shared := unsafe.StringData(string(k0.(skylark.String))) == unsafe.StringData(string(k70.(skylark.String)))
+			if shared != enabled {
+				t.Errorf("interning=%t: key %s shared=%t", enabled, k0, shared)
+			}
+		}
+		// Equality and hashing are unaffected.
+		if v, found, err := d70.Get(skylark.String("key0")); err != nil || !found || v.String() != "70" {
+			t.Errorf("interning=%t: d70[\"key0\"] = %v, %t, %v", enabled, v, found, err)
+		}
+	}
+}
+
+// BenchmarkInternKeys reports the heap retained by a workload that
+// builds thousands of dicts with overlapping keys, with and without
+// interning.
+func BenchmarkInternKeys(b *testing.B) {
+	for _, enabled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("intern=%t", enabled), func(b *testing.B) {
+			var before, after runtime.MemStats
+			var retained int64 // may go negative if GC frees unrelated memory
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				thread := new(skylark.Thread)
+				thread.SetInternKeys(enabled)
+				globals, err := skylark.ExecFile(thread, "intern.sky", internWorkload, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				retained += int64(after.HeapAlloc) - int64(before.HeapAlloc)
+				runtime.KeepAlive(globals)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "heap-B/op")
+		})
+	}
+}
+
+func TestUnusedGlobals(t *testing.T) {
+	const src = `
+load("lib.sky", "helper", "unused_import")
+used = 1
+unused = [used]
+counter = 0
+counter += 1
+def f(x=helper):
+    return g() + x
+def g():
+    return 1
+a, b = 1, 2
+c = b
+d = [x for x in [used]]
+fail_here = c[0]
+never = 1
+`
+	f, prog, err := skylark.SourceProgram("lint.sky", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread := &skylark.Thread{
+		Load: func(_ *skylark.Thread, module string) (skylark.StringDict, error) {
+			return skylark.StringDict{"helper": skylark.None, "unused_import": skylark.None}, nil
+		},
+	}
+	globals, err := prog.Init(thread, nil)
+	if err == nil {
+		t.Fatal("Init succeeded unexpectedly")
+	}
+	// counter is read by +=, and never is not reported because
+	// it was not assigned before the error.
+	got := strings.Join(skylark.UnusedGlobals(f, globals), " ")
+	if want := "unused_import unused f a d"; got != want {
+		t.Errorf("UnusedGlobals = %s, want %s", got, want)
+	}
+}
+
+func TestMakeBuiltin(t *testing.T) {
+	var printed []string
+	predeclared := skylark.StringDict{
+		"repeat": skylark.MakeBuiltin("repeat", strings.Repeat),
+		"join": skylark.MakeBuiltin("join", func(sep string, parts ...string) string {
+			return strings.Join(parts, sep)
+		}),
+		"sum": skylark.MakeBuiltin("sum", func(xs ...float64) float64 {
+			total := 0.0
+			for _, x := range xs {
+				total += x
+			}
+			return total
+		}),
+		"log": skylark.MakeBuiltin("log", func(thread *skylark.Thread, msg string) {
+			printed = append(printed, thread.Caller().Callable().Name()+": "+msg)
+		}),
+		"check": skylark.MakeBuiltin("check", func(ok bool) error {
+			if !ok {
+				return fmt.Errorf("check failed")
+			}
+			return nil
+		}),
+		"head": skylark.MakeBuiltin("head", func(list *skylark.List) (skylark.Value, error) {
+			if list.Len() == 0 {
+				return nil, nil // None
+			}
+			return list.Index(0), nil
+		}),
+		"size":  skylark.MakeBuiltin("size", func(d *skylark.Dict) uint8 { return uint8(d.Len()) }),
+		"str2":  skylark.MakeBuiltin("str2", func(s skylark.String) skylark.String { return s + s }),
+		"add64": skylark.MakeBuiltin("add64", func(x, y int64) int64 { return x + y }),
+	}
+	for _, test := range []struct {
+		src, want string
+	}{
+		{`repeat("ab", 3)`, `"ababab"`},
+		{`join(", ")`, `""`},
+		{`join(", ", "a", "b")`, `"a, b"`},
+		{`sum()`, `0.0`},
+		{`sum(1, 2.5, True)`, `4.5`},
+		{`log("hi")`, `None`},
+		{`check(True)`, `None`},
+		{`check(False)`, `check failed`},
+		{`head([])`, `None`},
+		{`head([1, 2])`, `1`},
+		{`size({1: 2})`, `1`},
+		{`str2("ab")`, `"abab"`},
+		{`add64(1 << 40, 1)`, `1099511627777`},
+		{`repeat("ab")`, `repeat: got 1 arguments, want 2`},
+		{`repeat("ab", 1, 2)`, `repeat: got 3 arguments, want 2`},
+		{`repeat(1, 1)`, `repeat: for parameter 1: got int, want string`},
+		{`repeat("ab", count=1)`, `repeat: unexpected keyword arguments`},
+		{`join(", ", "a", 1)`, `join: for parameter 3: got int, want string`},
+		{`join()`, `join: got 0 arguments, want 1`},
+		{`head({})`, `head: for parameter 1: got dict, want list`},
+		{`str2(1)`, `str2: for parameter 1: got int, want string`},
+		{`add64(1, "2")`, `add64: for parameter 2: got string, want int`},
+	} {
+		var got string
+		if v, err := skylark.Eval(new(skylark.Thread), "<expr>", test.src, predeclared); err != nil {
+			got = err.(*skylark.EvalError).Msg
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("%s = %s, want %s", test.src, got, test.want)
+		}
+	}
+	if got := strings.Join(printed, ";"); got != "<toplevel>: hi" {
+		t.Errorf("log printed %q", got)
+	}
+
+	// Unsupported functions are rejected.
+	for _, fn := range []interface{}{
+		"not a function",
+		func(x uint) {},
+		func(x skylark.HasAttrs) {},
+		func() []int { return nil },
+		func() (int, int) { return 0, 0 },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("MakeBuiltin(%T) did not panic", fn)
+				}
+			}()
+			skylark.MakeBuiltin("f", fn)
+		}()
+	}
+}
+
+// TestMaxDepth ensures that a chain of calls deeper than the thread's
+// limit fails cleanly, and that the depth is restored as the error unwinds.
+// (Skylark forbids direct recursion, so we use a chain of distinct functions.)
+func TestMaxDepth(t *testing.T) {
+	var src bytes.Buffer
+	src.WriteString("def f0(): return 0\n")
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&src, "def f%d(): return f%d() + 1\n", i, i-1)
+	}
+
+	thread := new(skylark.Thread)
+	thread.SetMaxDepth(10)
+	globals, err := skylark.ExecFile(thread, "depth.sky", src.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = skylark.Eval(thread, "<expr>", "f20()", globals)
+	if err == nil {
+		t.Fatal("deep call succeeded unexpectedly")
+	} else if !strings.Contains(err.Error(), "maximum recursion depth exceeded") {
+		t.Errorf("deep call failed with %q, want maximum recursion depth error", err)
+	}
+
+	// The same thread may still make calls within the limit.
+	v, err := skylark.Eval(thread, "<expr>", "f5()", globals)
+	if err != nil {
+		t.Fatalf("shallow call after error: %v", err)
+	}
+	if got := v.String(); got != "5" {
+		t.Errorf("f5() = %s, want 5", got)
+	}
+}
+
+// TestMaxSteps ensures that the step budget of a thread, and that of
+// a function returned by with_step_limit, bound the work it does.
+func TestMaxSteps(t *testing.T) {
+	const src = `
+def runaway():
+    for x in range(1000000000):
+        pass
+
+def work(n):
+    for x in range(n):
+        pass
+    return n
+`
+	thread := new(skylark.Thread)
+	globals, err := skylark.ExecFile(thread, "steps.sky", src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread.SetMaxSteps(thread.Steps() + 100000)
+	outer := thread.Steps() + 100000
+
+	for _, test := range []struct {
+		expr, want string
+	}{
+		{"with_step_limit(work, 1000)(10)", "10"},
+		{"with_step_limit(runaway, 1000)()", "step limit exceeded"},
+		// The outer budget is restored, and was not consumed by the above.
+		{"work(1000)", "1000"},
+		// The inner budget cannot loosen the outer one.
+		{"with_step_limit(runaway, 1000000000)()", "step limit exceeded"},
+	} {
+		var got string
+		if v, err := skylark.Eval(thread, "<expr>", test.expr, globals); err != nil {
+			got = err.(*skylark.EvalError).Msg
+		} else {
+			got = v.String()
+		}
+		if got != test.want {
+			t.Errorf("%s = %s, want %s", test.expr, got, test.want)
+		}
+	}
+	if steps := thread.Steps(); steps != outer+1 {
+		t.Errorf("thread stopped after %d steps, want %d", steps, outer+1)
+	}
+
+	// Removing the limit allows execution to resume.
+	thread.SetMaxSteps(0)
+	if _, err := skylark.Eval(thread, "<expr>", "work(10)", globals); err != nil {
+		t.Errorf("unlimited thread: %v", err)
+	}
+}
+
+// TestMaxAllocs ensures that the allocation budget of a thread bounds
+// the size of the values it creates.
+func TestMaxAllocs(t *testing.T) {
+	for _, test := range []struct {
+		expr  string
+		count uint64 // allocations counted with no limit
+	}{
+		{"1 + 2", 0},
+		{"[1, 2, 3]", 3},
+		{"(1, 2)", 2},
+		{`{"a": 1, "b": 2}`, 2},
+		{"[x for x in range(10)]", 10},
+		{"{x: x for x in range(10)}", 10},
+		{"list(range(10))", 10},
+		{"tuple(range(10))", 10},
+		{"[0] * 10", 1 + 10},
+		{"10 * (0,)", 1 + 10},
+		{`"ab" * 10`, 20},
+		{`str(123) + "de"`, 5},
+		{"[1] + list((2, 3))", 1 + 2 + 2 + 3},
+		{`"%d items" % 100`, 9},
+		{`"{} items".format(100)`, 9},
+		{`"x".join(["a", "b"])`, 2 + 3},
+		{"sorted(range(10))", 10},
+		{"reversed(range(10))", 10},
+		{"enumerate(range(10))", 10 * 3},
+		{"zip(range(10), range(10))", 10 * 3},
+		{"set(range(10))", 10},
+		{"[].extend(range(10))", 10},
+	} {
+		thread := new(skylark.Thread)
+		if _, err := skylark.Eval(thread, "<expr>", test.expr, nil); err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if got := thread.Allocs(); got != test.count {
+			t.Errorf("%s: Allocs() = %d, want %d", test.expr, got, test.count)
+		}
+	}
+
+	// Each of these would exceed the limit.
+	for _, expr := range []string{
+		"[0] * 1000000000",
+		`"x" * 1000000000`,
+		"[x for x in range(1000000000)]",
+		"list(range(1000000000))",
+		"tuple(range(1000000000))",
+		"{x: 0 for x in range(1000000000)}",
+		"sorted(range(1000000000))",
+		"reversed(range(1000000000))",
+		"enumerate(range(1000000000))",
+		"zip(range(1000000000))",
+		"set(range(1000000000))",
+		"{}.fromkeys(range(1000000000))",
+		"[].extend(range(1000000000))",
+		// s is within the limit on its own; only the result exceeds it.
+		`"%s%s" % (s, s)`,
+		`"{}{}".format(s, s)`,
+	} {
+		thread := new(skylark.Thread)
+		thread.SetMaxAllocs(1000)
+		env := skylark.StringDict{"s": skylark.String(strings.Repeat("x", 600))}
+		_, err := skylark.Eval(thread, "<expr>", expr, env)
+		if want := "allocation limit exceeded"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", expr, err, want)
+		}
+		if thread.Allocs() > 2000 {
+			t.Errorf("%s: allocated %d elements before failing", expr, thread.Allocs())
+		}
+	}
+
+	// The limit applies to the total across evaluations.
+	thread := new(skylark.Thread)
+	thread.SetMaxAllocs(10)
+	for i, want := range []string{"", "", "allocation limit exceeded"} {
+		var got string
+		if _, err := skylark.Eval(thread, "<expr>", "[1, 2, 3, 4]", nil); err != nil {
+			got = err.(*skylark.EvalError).Msg
+		}
+		if got != want {
+			t.Errorf("evaluation #%d: got error %q, want %q", i, got, want)
+		}
+	}
+	thread.SetMaxAllocs(0)
+	if _, err := skylark.Eval(thread, "<expr>", "[1, 2, 3, 4]", nil); err != nil {
+		t.Errorf("unlimited thread: %v", err)
+	}
+}
+
+// BenchmarkMaxAllocs measures the cost of allocation accounting in a
+// loop that allocates nothing, with and without a limit.
+func BenchmarkMaxAllocs(b *testing.B) {
+	const src = `
+def loop():
+    x = 0
+    for i in range(10000):
+        x += i * 2
+    return x
+`
+	for _, limit := range []uint64{0, 1 << 40} {
+		name := "unlimited"
+		if limit != 0 {
+			name = "limited"
+		}
+		thread := new(skylark.Thread)
+		globals, err := skylark.ExecFile(thread, "allocs.sky", src, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		thread.SetMaxAllocs(limit)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := skylark.Call(thread, globals["loop"], nil, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestLoadCache ensures that the evaluator memoizes Load within a
+// thread, detects cycles among loads made by the same thread, and
+// freezes loaded modules.
+func TestLoadCache(t *testing.T) {
+	fakeFilesystem := map[string]string{
+		"a.sky":    `a = [1]; a2 = 2`,
+		"main.sky": `load("a.sky", "a"); load("a.sky", "a2"); b = a + [a2]`,
+		"x.sky":    `load("y.sky", "y"); x = 1`,
+		"y.sky":    `load("x.sky", "x"); y = 1`,
+		"mut.sky":  `load("a.sky", "a"); a.append(3)`,
+	}
+	calls := make(map[string]int)
+	thread := new(skylark.Thread)
+	thread.Load = func(thread *skylark.Thread, module string) (skylark.StringDict, error) {
+		calls[module]++
+		// Loaded modules are executed by the same thread.
+		return skylark.ExecFile(thread, module, fakeFilesystem[module], nil)
+	}
+
+	globals, err := skylark.ExecFile(thread, "main.sky", fakeFilesystem["main.sky"], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := globals["b"].String(); got != "[1, 2]" {
+		t.Errorf("b = %s, want [1, 2]", got)
+	}
+	if calls["a.sky"] != 1 {
+		t.Errorf("a.sky loaded %d times, want 1", calls["a.sky"])
+	}
+
+	_, err = skylark.ExecFile(thread, "mut.sky", fakeFilesystem["mut.sky"], nil)
+	if want := "cannot append to frozen list"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("mutation of loaded value: got %v, want %q", err, want)
+	}
+
+	_, err = skylark.ExecFile(thread, "x.sky", fakeFilesystem["x.sky"], nil)
+	const want = "cannot load y.sky: cannot load x.sky: cannot load y.sky: cycle in load graph"
+	if err == nil || err.Error() != want {
+		t.Errorf("cyclic load: got %v, want %q", err, want)
+	}
+}
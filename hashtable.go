@@ -4,10 +4,7 @@
 
 package skylark
 
-import (
-	"fmt"
-	_ "unsafe" // for go:linkname hack
-)
+import "fmt"
 
 // hashtable is used to represent Skylark dict and set values.
 // It is a hash table whose key/value entries form a doubly-linked list
@@ -53,6 +50,18 @@ func (ht *hashtable) freeze() {
 	}
 }
 
+// checkMutable reports an error if the hash table is frozen
+// or has active iterators, using verb to describe the operation.
+func (ht *hashtable) checkMutable(verb string) error {
+	if ht.frozen {
+		return fmt.Errorf("cannot %s frozen hash table", verb)
+	}
+	if ht.itercount > 0 {
+		return fmt.Errorf("cannot %s hash table during iteration", verb)
+	}
+	return nil
+}
+
 func (ht *hashtable) insert(k, v Value) error {
 	if ht.frozen {
 		return fmt.Errorf("cannot insert into frozen hash table")
@@ -60,14 +69,21 @@ func (ht *hashtable) insert(k, v Value) error {
 	if ht.itercount > 0 {
 		return fmt.Errorf("cannot insert into hash table during iteration")
 	}
-	if ht.table == nil {
-		ht.table = ht.bucket0[:1]
-		ht.tailLink = &ht.head
-	}
 	h, err := k.Hash()
 	if err != nil {
 		return err
 	}
+	return ht.insertHashed(k, v, h)
+}
+
+// insertHashed is like insert, but uses h, the previously computed
+// hash of k, instead of calling k.Hash.  The caller must ensure that
+// the table is mutable.
+func (ht *hashtable) insertHashed(k, v Value, h uint32) error {
+	if ht.table == nil {
+		ht.table = ht.bucket0[:1]
+		ht.tailLink = &ht.head
+	}
 	if h == 0 {
 		h = 1 // zero is reserved
 	}
@@ -143,8 +159,6 @@ func (ht *hashtable) grow() {
 	// - avoid reentrant calls to ht.insert, and specialize it.
 	//   e.g. we know the calls to Equals will return false since
 	//   there are no duplicates among the old keys.
-	// - saving the entire hash in the bucket would avoid the need to
-	//   recompute the hash.
 	// - save the old buckets on a free list.
 	ht.table = make([]bucket, len(ht.table)<<1)
 	oldhead := ht.head
@@ -152,7 +166,7 @@ func (ht *hashtable) grow() {
 	ht.tailLink = &ht.head
 	ht.len = 0
 	for e := oldhead; e != nil; e = e.next {
-		ht.insert(e.key, e.value)
+		ht.insertHashed(e.key, e.value, e.hash)
 	}
 	ht.bucket0[0] = bucket{} // clear out unused initial bucket
 }
@@ -334,25 +348,97 @@ func (it *keyIterator) Done() {
 	}
 }
 
-// hashString computes the hash of s.
-func hashString(s string) uint32 {
-	if len(s) >= 12 {
-		// Call the Go runtime's optimized hash implementation,
-		// which uses the AESENC instruction on amd64 machines.
-		return uint32(goStringHash(s, 0))
+// iterateItems returns an iterator over the (key, value) pairs of the
+// table, in insertion order, without first copying them.
+func (ht *hashtable) iterateItems() *itemIterator {
+	if !ht.frozen {
+		ht.itercount++
 	}
-	return softHashString(s)
+	return &itemIterator{ht: ht, e: ht.head}
+}
+
+type itemIterator struct {
+	ht    *hashtable
+	e     *entry
+	array []Value // backing array for the next few pairs
 }
 
-//go:linkname goStringHash runtime.stringHash
-func goStringHash(s string, seed uintptr) uintptr
+// itemBatch is the number of pairs for which an itemIterator
+// allocates storage at once.
+const itemBatch = 32
 
-// softHashString computes the FNV hash of s in software.
-func softHashString(s string) uint32 {
-	var h uint32
+func (it *itemIterator) Next(p *Value) bool {
+	if it.e != nil {
+		if len(it.array) == 0 {
+			n := itemBatch
+			if int(it.ht.len) < n {
+				n = int(it.ht.len)
+			}
+			it.array = make([]Value, 2*n)
+		}
+		pair := Tuple(it.array[:2:2])
+		it.array = it.array[2:]
+		pair[0] = it.e.key
+		pair[1] = it.e.value
+		*p = pair
+		it.e = it.e.next
+		return true
+	}
+	return false
+}
+
+func (it *itemIterator) Done() {
+	if !it.ht.frozen {
+		it.ht.itercount--
+	}
+}
+
+// iterateValues returns an iterator over the values of the table,
+// in insertion order, without first copying them.
+func (ht *hashtable) iterateValues() *valueIterator {
+	if !ht.frozen {
+		ht.itercount++
+	}
+	return &valueIterator{ht: ht, e: ht.head}
+}
+
+type valueIterator struct {
+	ht *hashtable
+	e  *entry
+}
+
+func (it *valueIterator) Next(p *Value) bool {
+	if it.e != nil {
+		*p = it.e.value
+		it.e = it.e.next
+		return true
+	}
+	return false
+}
+
+func (it *valueIterator) Done() {
+	if !it.ht.frozen {
+		it.ht.itercount--
+	}
+}
+
+// hashString computes the hash of s using the 32-bit FNV-1a algorithm.
+//
+// The hash is a fixed function of s, independent of the process and
+// platform, so applications may persist hash values.  (An earlier
+// version used the Go runtime's faster hash for long strings, whose
+// seed varies from one run to the next.)
+func hashString(s string) uint32 {
+	h := uint32(fnvOffset)
 	for i := 0; i < len(s); i++ {
 		h ^= uint32(s[i])
-		h *= 16777619
+		h *= fnvPrime
 	}
 	return h
 }
+
+// Parameters of the 32-bit FNV-1a hash.
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
@@ -6,6 +6,7 @@ package skylark
 
 import (
 	"fmt"
+	"math/big"
 	"math/rand"
 	"testing"
 )
@@ -20,16 +21,41 @@ func BenchmarkStringHash(b *testing.B) {
 		rand.New(rand.NewSource(0)).Read(buf)
 		s := string(buf)
 
-		b.Run(fmt.Sprintf("hard-%d", len), func(b *testing.B) {
+		b.Run(fmt.Sprint(len), func(b *testing.B) {
 			for i := 0; i < b.N; i++ {
 				hashString(s)
 			}
 		})
-		b.Run(fmt.Sprintf("soft-%d", len), func(b *testing.B) {
-			for i := 0; i < b.N; i++ {
-				softHashString(s)
-			}
-		})
+	}
+}
+
+// TestStableHash checks the hash values of known inputs,
+// which must not vary across processes, platforms, or releases.
+func TestStableHash(t *testing.T) {
+	big := new(big.Int).Lsh(big.NewInt(1), 64)
+	for _, test := range []struct {
+		v    Value
+		want uint32
+	}{
+		// FNV-1a test vectors
+		{String(""), 0x811c9dc5},
+		{String("a"), 0xe40c292c},
+		{String("foobar"), 0xbf9cf968},
+		{String("a string of more than twelve bytes"), 0x70d75938},
+		{MakeInt(0), 0x811c9dc5},
+		{MakeInt(1), 0x040c5b8c},
+		{MakeInt(-1), ^uint32(0x040c5b8c)},
+		{MakeInt(1 << 32), 0x1076963a},
+		{Int{big}, 0x49b0f624},
+		{Float(1), 0x040c5b8c}, // same as int 1
+		{Tuple{String("a"), MakeInt(1)}, 0xa0f54308},
+	} {
+		got, err := test.v.Hash()
+		if err != nil {
+			t.Errorf("hash(%v) failed: %v", test.v, err)
+		} else if got != test.want {
+			t.Errorf("hash(%v) = %#08x, want %#08x", test.v, got, test.want)
+		}
 	}
 }
 
@@ -95,3 +121,78 @@ func testHashtable(tb testing.TB, sane map[int]bool) {
 		}
 	}
 }
+
+// TestSetMerge checks that the union of sorted sets computed by
+// merging is the same as that computed by hashing.
+func TestSetMerge(t *testing.T) {
+	defer func(n int) { setMergeThreshold = n }(setMergeThreshold)
+
+	rng := rand.New(rand.NewSource(0))
+	sortedSet := func(n int) *Set {
+		s := new(Set)
+		for k := 0; s.Len() < n; k += 1 + rng.Intn(3) {
+			s.Insert(String(fmt.Sprintf("%06d", k)))
+		}
+		return s
+	}
+	for i := 0; i < 50; i++ {
+		x, y := sortedSet(1+rng.Intn(100)), sortedSet(1+rng.Intn(100))
+
+		setMergeThreshold = 1 << 30 // hashing
+		want, _ := setUnion(x, y)
+		if mergeable(x, y) {
+			t.Fatal("mergeable below threshold")
+		}
+
+		setMergeThreshold = 1 // merging
+		got, _ := setUnion(x, y)
+		if !mergeable(x, y) {
+			t.Fatal("sets of sorted strings are not mergeable")
+		}
+
+		if got.String() != want.String() {
+			t.Errorf("%v | %v: merge gave %s, hash gave %s", x, y, got, want)
+		}
+	}
+
+	// Sets whose elements are unsorted or not all strings are not merged.
+	setMergeThreshold = 1
+	for _, elems := range []Tuple{
+		{String("b"), String("a")},
+		{String("a"), String("c"), String("b")},
+		{String("a"), String("a\x00"), String("")},
+		{String("a"), MakeInt(1)},
+		{MakeInt(1), MakeInt(2)},
+	} {
+		x := new(Set)
+		for _, elem := range elems {
+			x.Insert(elem)
+		}
+		if mergeable(x, x) {
+			t.Errorf("set %v is mergeable", x)
+		}
+	}
+}
+
+func BenchmarkSetUnion(b *testing.B) {
+	defer func(n int) { setMergeThreshold = n }(setMergeThreshold)
+
+	const n = 10000
+	x, y := new(Set), new(Set)
+	for i := 0; i < n; i++ {
+		x.Insert(String(fmt.Sprintf("element%08d", 2*i)))
+		y.Insert(String(fmt.Sprintf("element%08d", 3*i)))
+	}
+	for _, threshold := range []int{1 << 30, setMergeThreshold} {
+		method := "hash"
+		if threshold < n {
+			method = "merge"
+		}
+		setMergeThreshold = threshold
+		b.Run(method, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				setUnion(x, y)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"math"
 	"math/big"
+	"math/bits"
 
 	"github.com/google/skylark/syntax"
 )
@@ -116,12 +117,27 @@ func (i Int) String() string { return i.bigint.String() }
 func (i Int) Type() string   { return "int" }
 func (i Int) Freeze()        {} // immutable
 func (i Int) Truth() Bool    { return i.Sign() != 0 }
+
+// Hash returns a hash of the integer that is a fixed function of its
+// value, independent of the process and platform.  It applies FNV-1a
+// mixing to the 32-bit words of the magnitude, least significant
+// first, and complements the result for negative values.
 func (i Int) Hash() (uint32, error) {
-	var lo big.Word
-	if i.bigint.Sign() != 0 {
-		lo = i.bigint.Bits()[0]
+	h := uint32(fnvOffset)
+	words := i.bigint.Bits()
+	for j, w := range words {
+		h = (h ^ uint32(w)) * fnvPrime
+		// On 64-bit platforms, each big.Word holds two 32-bit words.
+		// Omit the most significant one if zero, for consistency
+		// with 32-bit platforms.
+		if hi := uint32(uint64(w) >> 32); bits.UintSize == 64 && (hi != 0 || j < len(words)-1) {
+			h = (h ^ hi) * fnvPrime
+		}
+	}
+	if i.bigint.Sign() < 0 {
+		h = ^h
 	}
-	return 12582917 * uint32(lo+3), nil
+	return h, nil
 }
 func (x Int) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
 	return threeway(op, x.bigint.Cmp(y.(Int).bigint)), nil
@@ -183,6 +199,18 @@ func AsInt32(x Value) (int, error) {
 	return 0, fmt.Errorf("%s out of range", i)
 }
 
+// AsInt64 returns the value of x if is representable as an int64.
+func AsInt64(x Value) (int64, error) {
+	i, ok := x.(Int)
+	if !ok {
+		return 0, fmt.Errorf("got %s, want int", x.Type())
+	}
+	if !i.bigint.IsInt64() {
+		return 0, fmt.Errorf("%s out of range", i)
+	}
+	return i.bigint.Int64(), nil
+}
+
 // NumberToInt converts a number x to an integer value.
 // An int is returned unchanged, a float is truncated towards zero.
 // NumberToInt reports an error for all other values.
@@ -37,7 +37,7 @@ import (
 const debug = false // TODO(adonovan): use a bitmap of options; and regexp to match files
 
 // Increment this to force recompilation of saved bytecode files.
-const Version = 3
+const Version = 4
 
 type Opcode uint8
 
@@ -303,6 +303,7 @@ type Funcode struct {
 	Freevars              []Ident         // for tracing
 	MaxStack              int
 	NumParams             int
+	NumPositionalOnly     int // number of leading params that may not be passed by keyword
 	HasVarargs, HasKwargs bool
 }
 
@@ -1672,6 +1673,10 @@ func (fcomp *fcomp) function(pos syntax.Position, name string, f *syntax.Functio
 	}
 
 	funcode.NumParams = len(f.Params)
+	if f.NumPositionalOnly > 0 {
+		funcode.NumParams-- // the / marker is not a parameter
+	}
+	funcode.NumPositionalOnly = f.NumPositionalOnly
 	funcode.HasVarargs = f.HasVarargs
 	funcode.HasKwargs = f.HasKwargs
 	fcomp.emit1(MAKEFUNC, fcomp.pcomp.functionIndex(funcode))
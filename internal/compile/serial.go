@@ -37,6 +37,7 @@ type gobFunction struct {
 	Freevars              []gobIdent
 	MaxStack              int
 	NumParams             int
+	NumPositionalOnly     int
 	HasVarargs, HasKwargs bool
 }
 
@@ -66,14 +67,15 @@ func (prog *Program) Write(out io.Writer) error {
 				Line: fn.Pos.Line,
 				Col:  fn.Pos.Col,
 			},
-			Code:       fn.Code,
-			Pclinetab:  fn.pclinetab,
-			Locals:     gobIdents(fn.Locals),
-			Freevars:   gobIdents(fn.Freevars),
-			MaxStack:   fn.MaxStack,
-			NumParams:  fn.NumParams,
-			HasVarargs: fn.HasVarargs,
-			HasKwargs:  fn.HasKwargs,
+			Code:              fn.Code,
+			Pclinetab:         fn.pclinetab,
+			Locals:            gobIdents(fn.Locals),
+			Freevars:          gobIdents(fn.Freevars),
+			MaxStack:          fn.MaxStack,
+			NumParams:         fn.NumParams,
+			NumPositionalOnly: fn.NumPositionalOnly,
+			HasVarargs:        fn.HasVarargs,
+			HasKwargs:         fn.HasKwargs,
 		}
 	}
 
@@ -142,17 +144,18 @@ func ReadProgram(in io.Reader) (*Program, error) {
 	ungobFunc := func(gf *gobFunction) *Funcode {
 		pos := syntax.MakePosition(&file, gf.Id.Line, gf.Id.Col)
 		return &Funcode{
-			Prog:       prog,
-			Pos:        pos,
-			Name:       gf.Id.Name,
-			Code:       gf.Code,
-			pclinetab:  gf.Pclinetab,
-			Locals:     ungobIdents(gf.Locals),
-			Freevars:   ungobIdents(gf.Freevars),
-			MaxStack:   gf.MaxStack,
-			NumParams:  gf.NumParams,
-			HasVarargs: gf.HasVarargs,
-			HasKwargs:  gf.HasKwargs,
+			Prog:              prog,
+			Pos:               pos,
+			Name:              gf.Id.Name,
+			Code:              gf.Code,
+			pclinetab:         gf.Pclinetab,
+			Locals:            ungobIdents(gf.Locals),
+			Freevars:          ungobIdents(gf.Freevars),
+			MaxStack:          gf.MaxStack,
+			NumParams:         gf.NumParams,
+			NumPositionalOnly: gf.NumPositionalOnly,
+			HasVarargs:        gf.HasVarargs,
+			HasKwargs:         gf.HasKwargs,
 		}
 	}
 
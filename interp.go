@@ -70,6 +70,12 @@ loop:
 	for {
 		savedpc = pc
 
+		thread.steps++
+		if thread.steps > thread.maxSteps && thread.maxSteps != 0 {
+			err = fmt.Errorf("step limit exceeded")
+			break loop
+		}
+
 		op := compile.Opcode(code[pc])
 		pc++
 		var arg uint32
@@ -114,7 +120,7 @@ loop:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
-			ok, err2 := Compare(op, x, y)
+			ok, err2 := thread.compare(op, x, y)
 			if err2 != nil {
 				err = err2
 				break loop
@@ -141,11 +147,22 @@ loop:
 			y := stack[sp-1]
 			x := stack[sp-2]
 			sp -= 2
-			z, err2 := Binary(binop, x, y)
+			if op == compile.STAR {
+				// Check the limit before allocating.
+				if err = thread.alloc(repeatSize(x, y)); err != nil {
+					break loop
+				}
+			}
+			z, err2 := binary(thread, binop, x, y)
 			if err2 != nil {
 				err = err2
 				break loop
 			}
+			if op == compile.PLUS || op == compile.PERCENT {
+				if err = thread.alloc(allocSize(z)); err != nil {
+					break loop
+				}
+			}
 			stack[sp] = z
 			sp++
 
@@ -178,7 +195,9 @@ loop:
 					if err = xlist.checkMutable("apply += to", true); err != nil {
 						break loop
 					}
-					listExtend(xlist, yiter)
+					if err = listExtend(thread, xlist, yiter); err != nil {
+						break loop
+					}
 					z = xlist
 				}
 			}
@@ -187,6 +206,9 @@ loop:
 				if err != nil {
 					break loop
 				}
+				if err = thread.alloc(allocSize(z)); err != nil {
+					break loop
+				}
 			}
 
 			stack[sp] = z
@@ -264,7 +286,7 @@ loop:
 			}
 			if args != nil {
 				// Add elements from *args sequence.
-				iter := Iterate(args)
+				iter := IterateThread(thread, args)
 				if iter == nil {
 					err = fmt.Errorf("argument after * must be iterable, not %s", args.Type())
 					break loop
@@ -274,6 +296,9 @@ loop:
 					positional = append(positional, elem)
 				}
 				iter.Done()
+				if err = IterErr(iter); err != nil {
+					break loop
+				}
 			}
 
 			function := stack[sp-1]
@@ -297,7 +322,7 @@ loop:
 		case compile.ITERPUSH:
 			x := stack[sp-1]
 			sp--
-			iter := Iterate(x)
+			iter := IterateThread(thread, x)
 			if iter == nil {
 				err = fmt.Errorf("%s value is not iterable", x.Type())
 				break loop
@@ -308,6 +333,8 @@ loop:
 			iter := iterstack[len(iterstack)-1]
 			if iter.Next(&stack[sp]) {
 				sp++
+			} else if err = IterErr(iter); err != nil {
+				break loop
 			} else {
 				pc = arg
 			}
@@ -329,6 +356,9 @@ loop:
 			y := stack[sp-2]
 			x := stack[sp-3]
 			sp -= 3
+			if _, ok := x.(*Dict); ok {
+				y = thread.internKey(y)
+			}
 			err = setIndex(fr, x, y, z)
 			if err != nil {
 				break loop
@@ -372,7 +402,7 @@ loop:
 
 		case compile.SETDICT, compile.SETDICTUNIQ:
 			dict := stack[sp-3].(*Dict)
-			k := stack[sp-2]
+			k := thread.internKey(stack[sp-2])
 			v := stack[sp-1]
 			sp -= 3
 			oldlen := dict.Len()
@@ -384,11 +414,17 @@ loop:
 				err = fmt.Errorf("duplicate key: %v", k)
 				break loop
 			}
+			if err = thread.alloc(1); err != nil {
+				break loop
+			}
 
 		case compile.APPEND:
 			elem := stack[sp-1]
 			list := stack[sp-2].(*List)
 			sp -= 2
+			if err = thread.alloc(1); err != nil {
+				break loop
+			}
 			list.elems = append(list.elems, elem)
 
 		case compile.SLICE:
@@ -409,7 +445,7 @@ loop:
 			n := int(arg)
 			iterable := stack[sp-1]
 			sp--
-			iter := Iterate(iterable)
+			iter := IterateThread(thread, iterable)
 			if iter == nil {
 				err = fmt.Errorf("got %s in sequence assignment", iterable.Type())
 				break loop
@@ -426,6 +462,9 @@ loop:
 				break loop
 			}
 			iter.Done()
+			if err = IterErr(iter); err != nil {
+				break loop
+			}
 			if i < n {
 				err = fmt.Errorf("too few values to unpack (got %d, want %d)", i, n)
 				break loop
@@ -443,6 +482,9 @@ loop:
 
 		case compile.MAKETUPLE:
 			n := int(arg)
+			if err = thread.alloc(uint64(n)); err != nil {
+				break loop
+			}
 			tuple := make(Tuple, n)
 			sp -= n
 			copy(tuple, stack[sp:])
@@ -451,6 +493,9 @@ loop:
 
 		case compile.MAKELIST:
 			n := int(arg)
+			if err = thread.alloc(uint64(n)); err != nil {
+				break loop
+			}
 			elems := make([]Value, n)
 			sp -= n
 			copy(elems, stack[sp:])
@@ -482,7 +527,7 @@ loop:
 				break loop
 			}
 
-			dict, err2 := thread.Load(thread, module)
+			dict, err2 := thread.load(module)
 			if err2 != nil {
 				err = fmt.Errorf("cannot load %s: %v", module, err2)
 				break loop
@@ -11,9 +11,12 @@ package skylark
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/big"
+	"math/bits"
 	"os"
 	"reflect"
 	"sort"
@@ -36,48 +39,90 @@ var Universe StringDict
 func init() {
 	// https://github.com/google/skylark/blob/master/doc/spec.md#built-in-constants-and-functions
 	Universe = StringDict{
-		"None":      None,
-		"True":      True,
-		"False":     False,
-		"any":       NewBuiltin("any", any),
-		"all":       NewBuiltin("all", all),
-		"bool":      NewBuiltin("bool", bool_),
-		"chr":       NewBuiltin("chr", chr),
-		"dict":      NewBuiltin("dict", dict),
-		"dir":       NewBuiltin("dir", dir),
-		"enumerate": NewBuiltin("enumerate", enumerate),
-		"float":     NewBuiltin("float", float), // requires resolve.AllowFloat
-		"getattr":   NewBuiltin("getattr", getattr),
-		"hasattr":   NewBuiltin("hasattr", hasattr),
-		"hash":      NewBuiltin("hash", hash),
-		"int":       NewBuiltin("int", int_),
-		"len":       NewBuiltin("len", len_),
-		"list":      NewBuiltin("list", list),
-		"max":       NewBuiltin("max", minmax),
-		"min":       NewBuiltin("min", minmax),
-		"ord":       NewBuiltin("ord", ord),
-		"print":     NewBuiltin("print", print),
-		"range":     NewBuiltin("range", range_),
-		"repr":      NewBuiltin("repr", repr),
-		"reversed":  NewBuiltin("reversed", reversed),
-		"set":       NewBuiltin("set", set), // requires resolve.AllowSet
-		"sorted":    NewBuiltin("sorted", sorted),
-		"str":       NewBuiltin("str", str),
-		"tuple":     NewBuiltin("tuple", tuple),
-		"type":      NewBuiltin("type", type_),
-		"zip":       NewBuiltin("zip", zip),
-	}
-}
-
-type builtinMethod func(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error)
+		"None":            None,
+		"True":            True,
+		"False":           False,
+		"any":             NewBuiltin("any", any).WithSignature("x", "predicate?"),
+		"all":             NewBuiltin("all", all).WithSignature("x", "predicate?"),
+		"bool":            NewBuiltin("bool", bool_).WithSignature("x?"),
+		"bucket":          NewBuiltin("bucket", bucket_).WithSignature("key", "n"),
+		"by":              NewBuiltin("by", by).WithSignature("*key_funcs"),
+		"byte_chr":        NewBuiltin("byte_chr", byte_chr).WithSignature("i"),
+		"byte_ord":        NewBuiltin("byte_ord", byte_ord).WithSignature("s"),
+		"cache_key":       NewBuiltin("cache_key", cache_key).WithSignature("x"),
+		"caller_location": NewBuiltin("caller_location", caller_location).WithSignature(),
+		"chr":             NewBuiltin("chr", chr).WithSignature("i"),
+		"command_line":    NewBuiltin("command_line", command_line).WithSignature("args", "quote?", "sep?"),
+		"deep_isclose":    NewBuiltin("deep_isclose", deep_isclose).WithSignature("a", "b", "rel_tol?"),
+		"desc":            NewBuiltin("desc", desc).WithSignature("key_func"),
+		"describe":        NewBuiltin("describe", describe).WithSignature("x"),
+		"dict":            NewBuiltin("dict", dict).WithSignature("pairs?", "**kwargs"),
+		"dir":             NewBuiltin("dir", dir).WithSignature("x"),
+		"enum":            NewBuiltin("enum", enum).WithSignature("**kwargs"),
+		"enumerate":       NewBuiltin("enumerate", enumerate).WithSignature("x", "start?"),
+		"enumerate_items": NewBuiltin("enumerate_items", enumerate_items).WithSignature("dict", "start?"),
+		"escape":          NewBuiltin("escape", escape).WithSignature("s"),
+		"expect_type":     NewBuiltin("expect_type", expect_type).WithSignature("x", "type_name"),
+		"fail":            NewBuiltin("fail", fail).WithSignature("*args", "sep?"),
+		"filter":          NewBuiltin("filter", filter).WithSignature("function", "iterable"),
+		"filter_items":    NewBuiltin("filter_items", filter_items).WithSignature("dict", "pred"),
+		"flatten_dict":    NewBuiltin("flatten_dict", flatten_dict).WithSignature("dict", "sep?"),
+		"float":           NewBuiltin("float", float).WithSignature("x?"), // requires resolve.AllowFloat
+		"freeze_dict":     NewBuiltin("freeze_dict", freeze_dict).WithSignature("d", "in_place?"),
+		"frozen_copy":     NewBuiltin("frozen_copy", frozen_copy).WithSignature("x"),
+		"getattr":         NewBuiltin("getattr", getattr).WithSignature("x", "name", "default?"),
+		"globals":         NewBuiltin("globals", globals).WithSignature(),
+		"hasattr":         NewBuiltin("hasattr", hasattr).WithSignature("x", "name"),
+		"hash":            NewBuiltin("hash", hash).WithSignature("x"),
+		"id":              NewBuiltin("id", id).WithSignature("x"),
+		"int":             NewBuiltin("int", int_).WithSignature("x", "base?"),
+		"is_hashable":     NewBuiltin("is_hashable", is_hashable).WithSignature("x"),
+		"is_type":         NewBuiltin("is_type", is_type).WithSignature("x", "names"),
+		"len":             NewBuiltin("len", len_).WithSignature("x"),
+		"list":            NewBuiltin("list", list).WithSignature("x?"),
+		"map":             NewBuiltin("map", map_).WithSignature("function", "iterable", "*iterables"),
+		"match":           NewBuiltin("match", match).WithSignature("value", "cases", "default?"),
+		"max":             NewBuiltin("max", minmax).WithSignature("*args", "key?"),
+		"memoize":         NewBuiltin("memoize", memoize).WithSignature("fn"),
+		"min":             NewBuiltin("min", minmax).WithSignature("*args", "key?"),
+		"ord":             NewBuiltin("ord", ord).WithSignature("s"),
+		"parse_bool":      NewBuiltin("parse_bool", parse_bool).WithSignature("s"),
+		"predeclared":     NewBuiltin("predeclared", predeclared).WithSignature(),
+		"print":           NewBuiltin("print", print).WithSignature("*args", "sep?", "end?", "**kwargs"),
+		"range":           NewBuiltin("range", range_).WithSignature("start_or_stop", "stop?", "step?"),
+		"repr":            NewBuiltin("repr", repr).WithSignature("x", "limit?"),
+		"require":         NewBuiltin("require", require).WithSignature("cond", "message"),
+		"reversed":        NewBuiltin("reversed", reversed).WithSignature("x"),
+		"set":             NewBuiltin("set", set).WithSignature("x?"), // requires resolve.AllowSet
+		"sorted":          NewBuiltin("sorted", sorted).WithSignature("iterable", "*", "key?", "reverse?"),
+		"stack_depth":     NewBuiltin("stack_depth", stack_depth).WithSignature(),
+		"str":             NewBuiltin("str", str).WithSignature("x"),
+		"string_builder":  NewBuiltin("string_builder", string_builder).WithSignature(),
+		"tuple":           NewBuiltin("tuple", tuple).WithSignature("x?"),
+		"type":            NewBuiltin("type", type_).WithSignature("x"),
+		"type_is":         NewBuiltin("type_is", type_is).WithSignature("x", "name"),
+		"unescape":        NewBuiltin("unescape", unescape).WithSignature("s"),
+		"unflatten":       NewBuiltin("unflatten", unflatten).WithSignature("dict", "sep?"),
+		"vars":            NewBuiltin("vars", vars).WithSignature("x", "strict?"),
+		"weighted_index":  NewBuiltin("weighted_index", weighted_index).WithSignature("weights", "seed"),
+		"with_step_limit": NewBuiltin("with_step_limit", with_step_limit).WithSignature("fn", "n"),
+		"zip":             NewBuiltin("zip", zip).WithSignature("*args"),
+	}
+}
+
+type builtinMethod func(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error)
 
 // methods of built-in types
 // https://github.com/google/skylark/blob/master/doc/spec.md#built-in-methods
 var (
 	dictMethods = map[string]builtinMethod{
 		"clear":      dict_clear,
+		"fromkeys":   dict_fromkeys,
 		"get":        dict_get,
 		"items":      dict_items,
+		"iteritems":  dict_iteritems,
+		"iterkeys":   dict_iterkeys,
+		"itervalues": dict_itervalues,
 		"keys":       dict_keys,
 		"pop":        dict_pop,
 		"popitem":    dict_popitem,
@@ -133,7 +178,20 @@ var (
 	}
 
 	setMethods = map[string]builtinMethod{
-		"union": set_union,
+		"difference_update":           set_difference_update,
+		"intersection_update":         set_intersection_update,
+		"symmetric_difference_update": set_symmetric_difference_update,
+		"union":                       set_union,
+		"update":                      set_update,
+	}
+
+	enumMethods = map[string]builtinMethod{
+		"values": enum_values,
+	}
+
+	stringBuilderMethods = map[string]builtinMethod{
+		"append": string_builder_append,
+		"build":  string_builder_build,
 	}
 )
 
@@ -147,6 +205,10 @@ func builtinMethodOf(recv Value, name string) builtinMethod {
 		return dictMethods[name]
 	case *Set:
 		return setMethods[name]
+	case *StringBuilder:
+		return stringBuilderMethods[name]
+	case *enumValue:
+		return enumMethods[name]
 	}
 	return nil
 }
@@ -159,7 +221,13 @@ func builtinAttr(recv Value, name string, methods map[string]builtinMethod) (Val
 
 	// Allocate a closure over 'method'.
 	impl := func(thread *Thread, b *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-		return method(b.Name(), b.Receiver(), args, kwargs)
+		v, err := method(thread, b.Name(), b.Receiver(), args, kwargs)
+		if s, ok := v.(String); ok && err == nil {
+			if _, ok := recv.(String); ok {
+				err = thread.alloc(uint64(len(s))) // e.g. string.format
+			}
+		}
+		return v, err
 	}
 	return NewBuiltin(name, impl).BindReceiver(recv), nil
 }
@@ -177,29 +245,90 @@ func builtinAttrNames(methods map[string]builtinMethod) []string {
 // supplied parameter variables.  pairs is an alternating list of names
 // and pointers to variables.
 //
-// If the variable is a bool, int, string, *List, *Dict, Callable,
-// Iterable, or user-defined implementation of Value,
-// UnpackArgs performs the appropriate type check.
-// (An int uses the AsInt32 check.)
+// If the variable is a bool, int, int64, float64, string, Int, Float,
+// *List, *Dict, *Set, Tuple, Callable, Iterable, or user-defined
+// implementation of Value, UnpackArgs performs the appropriate type check.
+// (An int uses the AsInt32 check, an int64 the AsInt64 check.)
+// A Float or float64 variable accepts a bool, int, or float argument,
+// converting it to float; a float64 variable additionally rejects
+// values that are not finite, including ints too large for a float.
 // If the parameter name ends with "?",
 // it and all following parameters are optional.
+// The variable of an optional parameter is left unchanged if its
+// argument is omitted, unless the variable is wrapped by Default.
+//
+// A parameter whose name begins with "*", such as "*args", must have a
+// variable of type Tuple; it receives all positional arguments not
+// assigned to earlier parameters, and all parameters following it may
+// be given only by keyword.  A parameter named just "*", whose variable
+// must be nil, marks all the parameters following it as keyword-only
+// without accepting surplus positional arguments; an attempt to supply
+// one of them positionally is an error.  A final parameter whose name
+// begins with "**", such as "**kwargs", must have a variable of type
+// []Tuple or StringDict; it receives all keyword arguments that do not
+// match the name of another parameter.
 //
 // If the variable implements Value, UnpackArgs may call
 // its Type() method while constructing the error message.
 //
-// Beware: an optional *List, *Dict, Callable, Iterable, or Value variable that is
-// not assigned is not a valid Skylark Value, so the caller must
-// explicitly handle such cases by interpreting nil as None or some
-// computed default.
+// Beware: an optional *List, *Dict, *Set, Callable, Iterable, or Value
+// variable that is not assigned is not a valid Skylark Value, so the
+// caller must explicitly handle such cases by interpreting nil as None
+// or some computed default.  An explicit None argument assigns None to
+// a Value variable, so a nil Value indicates that the argument was
+// omitted, allowing the caller to distinguish the two cases.
 func UnpackArgs(fnname string, args Tuple, kwargs []Tuple, pairs ...interface{}) error {
 	nparams := len(pairs) / 2
+
+	// Remove the **kwargs and *args parameters, if any.
+	var varargs, varkwargs interface{}
+	if nparams > 0 && strings.HasPrefix(pairs[2*nparams-2].(string), "**") {
+		varkwargs = pairs[2*nparams-1]
+		pairs = pairs[:2*nparams-2]
+		nparams--
+	}
+	npositional := nparams // number of parameters that accept positional arguments
+	kwonly := false        // whether a bare "*" precedes the keyword-only parameters
+	for i := 0; i < nparams; i++ {
+		if name := pairs[2*i].(string); strings.HasPrefix(name, "*") {
+			if name == "*" {
+				if pairs[2*i+1] != nil {
+					log.Fatalf("internal error: non-nil variable for * parameter of %s", fnname)
+				}
+				kwonly = true
+			} else {
+				varargs = pairs[2*i+1]
+			}
+			pairs = append(pairs[:2*i:2*i], pairs[2*i+2:]...) // copy, don't clobber caller's slice
+			nparams--
+			npositional = i
+			break
+		}
+	}
+
 	var defined intset
 	defined.init(nparams)
 
 	// positional arguments
-	if len(args) > nparams {
-		return fmt.Errorf("%s: got %d arguments, want at most %d",
-			fnname, len(args), nparams)
+	var surplus Tuple
+	if len(args) > npositional {
+		if kwonly && npositional < nparams {
+			name := strings.TrimSuffix(pairs[2*npositional].(string), "?")
+			return fmt.Errorf("%s: got %d positional arguments, want at most %d (%s is keyword-only)",
+				fnname, len(args), npositional, name)
+		}
+		if varargs == nil {
+			return fmt.Errorf("%s: got %d arguments, want at most %d",
+				fnname, len(args), npositional)
+		}
+		args, surplus = args[:npositional], args[npositional:]
+	}
+	if varargs != nil {
+		ptr, ok := varargs.(*Tuple)
+		if !ok {
+			log.Fatalf("internal error: invalid pointer type for *args: %T", varargs)
+		}
+		*ptr = surplus
 	}
 	for i, arg := range args {
 		defined.set(i)
@@ -209,6 +338,7 @@ func UnpackArgs(fnname string, args Tuple, kwargs []Tuple, pairs ...interface{})
 	}
 
 	// keyword arguments
+	var extra []Tuple // keyword arguments for **kwargs
 kwloop:
 	for _, item := range kwargs {
 		name, arg := item[0].(String), item[1]
@@ -230,7 +360,23 @@ kwloop:
 				continue kwloop
 			}
 		}
-		return fmt.Errorf("%s: unexpected keyword argument %s", fnname, name)
+		if varkwargs == nil {
+			return fmt.Errorf("%s: unexpected keyword argument %s", fnname, name)
+		}
+		extra = append(extra, item)
+	}
+	if varkwargs != nil {
+		switch ptr := varkwargs.(type) {
+		case *[]Tuple:
+			*ptr = extra
+		case *StringDict:
+			*ptr = make(StringDict, len(extra))
+			for _, item := range extra {
+				(*ptr)[string(item[0].(String))] = item[1]
+			}
+		default:
+			log.Fatalf("internal error: invalid pointer type for **kwargs: %T", varkwargs)
+		}
 	}
 
 	// Check that all non-optional parameters are defined.
@@ -245,9 +391,50 @@ kwloop:
 		}
 	}
 
+	// Apply the defaults of omitted parameters.
+	for i := len(args); i < nparams; i++ {
+		if d, ok := pairs[2*i+1].(*defaultVar); ok && !defined.get(i) {
+			d.apply()
+		}
+	}
+
 	return nil
 }
 
+// Default returns a variable for use with UnpackArgs or
+// UnpackPositionalArgs that is equivalent to ptr, except that if the
+// argument for the parameter is omitted, *ptr is set to value.
+// Value must be assignable to *ptr.
+//
+// For example, this unpacks an optional parameter whose default is 10:
+//
+//	var count int
+//	err := UnpackArgs("f", args, kwargs, "count?", Default(&count, 10))
+//
+// A default is relevant only to an optional parameter, one at or
+// after the first parameter whose name ends with "?".
+func Default(ptr, value interface{}) interface{} {
+	return &defaultVar{ptr, value}
+}
+
+type defaultVar struct {
+	ptr, value interface{}
+}
+
+// apply sets the variable to its default value.
+func (d *defaultVar) apply() {
+	elem := reflect.ValueOf(d.ptr).Elem()
+	if d.value == nil {
+		elem.Set(reflect.Zero(elem.Type()))
+		return
+	}
+	v := reflect.ValueOf(d.value)
+	if !v.Type().AssignableTo(elem.Type()) {
+		log.Fatalf("internal error: default %T not assignable to %s", d.value, elem.Type())
+	}
+	elem.Set(v)
+}
+
 // UnpackPositionalArgs unpacks the positional arguments into
 // corresponding variables.  Each element of vars is a pointer; see
 // UnpackArgs for allowed types and conversions.
@@ -279,12 +466,19 @@ func UnpackPositionalArgs(fnname string, args Tuple, kwargs []Tuple, min int, va
 			return fmt.Errorf("%s: for parameter %d: %s", fnname, i+1, err)
 		}
 	}
+	for _, v := range vars[len(args):] {
+		if d, ok := v.(*defaultVar); ok {
+			d.apply()
+		}
+	}
 	return nil
 }
 
 func unpackOneArg(v Value, ptr interface{}) error {
 	ok := true
 	switch ptr := ptr.(type) {
+	case *defaultVar:
+		return unpackOneArg(v, ptr.ptr)
 	case *Value:
 		*ptr = v
 	case *string:
@@ -300,6 +494,34 @@ func unpackOneArg(v Value, ptr interface{}) error {
 		if err != nil {
 			return err
 		}
+	case *int64:
+		var err error
+		*ptr, err = AsInt64(v)
+		if err != nil {
+			return err
+		}
+	case *Int:
+		*ptr, ok = v.(Int)
+		if !ok {
+			return fmt.Errorf("got %s, want int", v.Type())
+		}
+	case *Float:
+		*ptr, ok = toFloat(v)
+		if !ok {
+			return fmt.Errorf("got %s, want float", v.Type())
+		}
+	case *float64:
+		f, ok := toFloat(v)
+		if !ok {
+			return fmt.Errorf("got %s, want float", v.Type())
+		}
+		if !isFinite(float64(f)) {
+			if _, ok := v.(Int); ok {
+				return fmt.Errorf("int too large to convert to float")
+			}
+			return fmt.Errorf("got %s, want finite float", f)
+		}
+		*ptr = float64(f)
 	case **List:
 		*ptr, ok = v.(*List)
 		if !ok {
@@ -310,6 +532,16 @@ func unpackOneArg(v Value, ptr interface{}) error {
 		if !ok {
 			return fmt.Errorf("got %s, want dict", v.Type())
 		}
+	case **Set:
+		*ptr, ok = v.(*Set)
+		if !ok {
+			return fmt.Errorf("got %s, want set", v.Type())
+		}
+	case *Tuple:
+		*ptr, ok = v.(Tuple)
+		if !ok {
+			return fmt.Errorf("got %s, want tuple", v.Type())
+		}
 	case *Callable:
 		*ptr, ok = v.(Callable)
 		if !ok {
@@ -340,42 +572,241 @@ func unpackOneArg(v Value, ptr interface{}) error {
 	return nil
 }
 
+// MakeBuiltin returns a new built-in function with the specified name
+// whose implementation calls the Go function fn, which may have any
+// number of parameters.  It saves clients from writing the
+// conversions between Skylark and Go values by hand.
+//
+// Each Skylark argument, which must be positional, is converted to the
+// type of the corresponding Go parameter as if by UnpackPositionalArgs.
+// The permitted parameter types are those supported by UnpackArgs.
+// If fn is variadic, surplus arguments are converted to the element
+// type of its final parameter, like Skylark's *args.
+// If the first parameter has type *Thread, it receives the calling
+// thread and corresponds to no argument.
+//
+// fn may return no results, a single result, or a result and an error,
+// or just an error.  A result is converted to a Skylark value: a Value
+// is returned as is, or None if nil; a Go string, bool, integer, or
+// floating-point number becomes a string, bool, int, or float.
+//
+// MakeBuiltin panics if fn is not a function or any of its
+// parameter or result types is not supported.
+//
+// Example:
+//
+//	skylark.MakeBuiltin("repeat", strings.Repeat)
+func MakeBuiltin(name string, fn interface{}) *Builtin {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	if ft.Kind() != reflect.Func {
+		panic(fmt.Sprintf("MakeBuiltin(%s): got %s, want function", name, ft))
+	}
+
+	// Check the parameter types.
+	params := make([]reflect.Type, ft.NumIn())
+	for i := range params {
+		params[i] = ft.In(i)
+	}
+	wantThread := len(params) > 0 && params[0] == reflect.TypeOf((*Thread)(nil))
+	if wantThread {
+		params = params[1:]
+	}
+	var varargs reflect.Type // element type of variadic parameter
+	if ft.IsVariadic() {
+		varargs = params[len(params)-1].Elem()
+		params = params[:len(params)-1]
+	}
+	for _, t := range append(params[:len(params):len(params)], varargs) {
+		if t != nil && !isUnpackable(t) {
+			panic(fmt.Sprintf("MakeBuiltin(%s): unsupported parameter type %s", name, t))
+		}
+	}
+
+	// Check the result types.
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	results := make([]reflect.Type, ft.NumOut())
+	for i := range results {
+		results[i] = ft.Out(i)
+	}
+	hasError := len(results) > 0 && results[len(results)-1] == errorType
+	if hasError {
+		results = results[:len(results)-1]
+	}
+	if len(results) > 1 || len(results) == 1 && !isConvertible(results[0]) {
+		panic(fmt.Sprintf("MakeBuiltin(%s): unsupported result types of %s", name, ft))
+	}
+
+	impl := func(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+		fixed, surplus := args, Tuple(nil)
+		if varargs != nil && len(args) > len(params) {
+			fixed, surplus = args[:len(params)], args[len(params):]
+		}
+		vars := make([]interface{}, len(params))
+		for i, t := range params {
+			vars[i] = reflect.New(t).Interface()
+		}
+		if err := UnpackPositionalArgs(name, fixed, kwargs, len(params), vars...); err != nil {
+			return nil, err
+		}
+
+		in := make([]reflect.Value, 0, ft.NumIn()+len(surplus))
+		if wantThread {
+			in = append(in, reflect.ValueOf(thread))
+		}
+		for _, v := range vars {
+			in = append(in, reflect.ValueOf(v).Elem())
+		}
+		for i, arg := range surplus {
+			ptr := reflect.New(varargs)
+			if err := unpackOneArg(arg, ptr.Interface()); err != nil {
+				return nil, fmt.Errorf("%s: for parameter %d: %s", name, len(params)+i+1, err)
+			}
+			in = append(in, ptr.Elem())
+		}
+
+		out := fv.Call(in)
+		if hasError {
+			if err := out[len(out)-1]; !err.IsNil() {
+				return nil, err.Interface().(error)
+			}
+		}
+		if len(results) == 0 {
+			return None, nil
+		}
+		return fromGo(out[0]), nil
+	}
+	return NewBuiltin(name, impl)
+}
+
+// isUnpackable reports whether unpackOneArg accepts a pointer to a variable of type t.
+func isUnpackable(t reflect.Type) bool {
+	switch reflect.New(t).Interface().(type) {
+	case *Value, *string, *bool, *int, *int64, *Int, *Float, *float64,
+		**List, **Dict, **Set, *Tuple, *Callable, *Iterable:
+		return true
+	}
+	// Other concrete types that implement Value are handled by reflection.
+	return t.Kind() != reflect.Interface && t.Implements(reflect.TypeOf((*Value)(nil)).Elem())
+}
+
+// isConvertible reports whether fromGo accepts values of type t.
+func isConvertible(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return t.Implements(reflect.TypeOf((*Value)(nil)).Elem())
+}
+
+// fromGo converts a Go value of a type accepted by isConvertible to a Skylark value.
+func fromGo(v reflect.Value) Value {
+	if (v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && v.IsNil() {
+		return None
+	}
+	if x, ok := v.Interface().(Value); ok {
+		return x
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return String(v.String())
+	case reflect.Bool:
+		return Bool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return MakeInt64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return MakeUint64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return Float(v.Float())
+	}
+	panic(fmt.Sprintf("unexpected type %s", v.Type()))
+}
+
+// toFloat converts a bool, int, or float to a float.
+func toFloat(v Value) (Float, bool) {
+	switch v := v.(type) {
+	case Float:
+		return v, true
+	case Int:
+		return v.Float(), true
+	case Bool:
+		if v {
+			return 1.0, true
+		}
+		return 0.0, true
+	}
+	return 0, false
+}
+
 // ---- built-in functions ----
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#all
 func all(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
-	if err := UnpackPositionalArgs("all", args, kwargs, 1, &iterable); err != nil {
+	var pred Callable
+	if err := UnpackPositionalArgs("all", args, kwargs, 1, &iterable, &pred); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
+	iter := IterateThread(thread, iterable)
 	defer iter.Done()
 	var x Value
-	for iter.Next(&x) {
-		if !x.Truth() {
+	for i := 0; iter.Next(&x); i++ {
+		if ok, err := satisfies(thread, "all", pred, i, x); err != nil {
+			return nil, err
+		} else if !ok {
 			return False, nil
 		}
 	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
 	return True, nil
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#any
 func any(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
-	if err := UnpackPositionalArgs("all", args, kwargs, 1, &iterable); err != nil {
+	var pred Callable
+	if err := UnpackPositionalArgs("any", args, kwargs, 1, &iterable, &pred); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
+	iter := IterateThread(thread, iterable)
 	defer iter.Done()
 	var x Value
-	for iter.Next(&x) {
-		if x.Truth() {
+	for i := 0; iter.Next(&x); i++ {
+		if ok, err := satisfies(thread, "any", pred, i, x); err != nil {
+			return nil, err
+		} else if ok {
 			return True, nil
 		}
 	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
 	return False, nil
 }
 
+// satisfies reports whether the ith element x of the operand of any or
+// all is true, or, if pred is non-nil, whether pred(x) is true.
+func satisfies(thread *Thread, fnname string, pred Callable, i int, x Value) (bool, error) {
+	if pred == nil {
+		return bool(x.Truth()), nil
+	}
+	v, err := Call(thread, pred, Tuple{x}, nil)
+	if err != nil {
+		msg := fmt.Sprintf("%s: predicate failed for element %d: ", fnname, i)
+		if err, ok := err.(*EvalError); ok {
+			// Preserve the backtrace of the failed predicate.
+			return false, &EvalError{Msg: msg + err.Msg, Frame: err.Frame}
+		}
+		return false, fmt.Errorf("%s%v", msg, err)
+	}
+	return bool(v.Truth()), nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#bool
 func bool_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var x Value = False
@@ -385,143 +816,1049 @@ func bool_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	return x.Truth(), nil
 }
 
-// https://github.com/google/skylark/blob/master/doc/spec.md#chr
-func chr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	if len(kwargs) > 0 {
-		return nil, fmt.Errorf("chr does not accept keyword arguments")
+// https://github.com/google/skylark/blob/master/doc/spec.md#bucket
+func bucket_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var key string
+	var n int
+	if err := UnpackPositionalArgs("bucket", args, kwargs, 2, &key, &n); err != nil {
+		return nil, err
 	}
-	if len(args) != 1 {
-		return nil, fmt.Errorf("chr: got %d arguments, want 1", len(args))
+	if n <= 0 {
+		return nil, fmt.Errorf("bucket: got %d buckets, want positive number", n)
 	}
-	i, err := AsInt32(args[0])
-	if err != nil {
-		return nil, fmt.Errorf("chr: got %s, want int", args[0].Type())
+	return MakeInt(jumpHash(uint64(mixHash(hashString(key))), n)), nil
+}
+
+// jumpHash returns the bucket in [0, n) for the specified key using
+// the "jump" consistent hash of Lamping and Veach: when n increases,
+// only 1/n of the keys move, all of them to the new bucket.
+func jumpHash(key uint64, n int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(1<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#by
+func by(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("by does not accept keyword arguments")
 	}
-	if i < 0 {
-		return nil, fmt.Errorf("chr: Unicode code point %d out of range (<0)", i)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("by: got 0 arguments, want at least 1")
 	}
-	if i > unicode.MaxRune {
-		return nil, fmt.Errorf("chr: Unicode code point U+%X out of range (>0x10FFFF)", i)
+	keys := make([]Callable, len(args))
+	for i, arg := range args {
+		fn, ok := arg.(Callable)
+		if !ok {
+			return nil, fmt.Errorf("by: for parameter %d: got %s, want callable", i+1, arg.Type())
+		}
+		keys[i] = fn
 	}
-	return String(string(i)), nil
+	return &compositeKey{keys: keys}, nil
 }
 
-// https://github.com/google/skylark/blob/master/doc/spec.md#dict
-func dict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	if len(args) > 1 {
-		return nil, fmt.Errorf("dict: got %d arguments, want at most 1", len(args))
+// A compositeKey is a function returned by by.
+// It returns the tuple of the results of its key functions.
+type compositeKey struct {
+	keys []Callable
+}
+
+var _ Callable = (*compositeKey)(nil)
+
+func (k *compositeKey) Name() string { return "by" }
+func (k *compositeKey) String() string {
+	names := make([]string, len(k.keys))
+	for i, fn := range k.keys {
+		names[i] = fn.String()
 	}
-	dict := new(Dict)
-	if err := updateDict(dict, args, kwargs); err != nil {
-		return nil, fmt.Errorf("dict: %v", err)
+	return fmt.Sprintf("<by %s>", strings.Join(names, ", "))
+}
+func (k *compositeKey) Type() string { return "composite_key" }
+func (k *compositeKey) Freeze() {
+	for _, fn := range k.keys {
+		fn.Freeze()
 	}
-	return dict, nil
 }
-
-// https://github.com/google/skylark/blob/master/doc/spec.md#dir
-func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	if len(kwargs) > 0 {
-		return nil, fmt.Errorf("dir does not accept keyword arguments")
+func (k *compositeKey) Truth() Bool { return True }
+func (k *compositeKey) Hash() (uint32, error) {
+	t := make(Tuple, len(k.keys))
+	for i, fn := range k.keys {
+		t[i] = fn
 	}
-	if len(args) != 1 {
-		return nil, fmt.Errorf("dir: got %d arguments, want 1", len(args))
+	return t.Hash()
+}
+
+func (k *compositeKey) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	result := make(Tuple, len(k.keys))
+	for i, fn := range k.keys {
+		v, err := Call(thread, fn, args, kwargs)
+		if err != nil {
+			return nil, err // to preserve backtrace, don't modify error
+		}
+		result[i] = v
 	}
+	return result, nil
+}
 
-	var names []string
-	if x, ok := args[0].(HasAttrs); ok {
-		names = x.AttrNames()
+// https://github.com/google/skylark/blob/master/doc/spec.md#byte_chr
+func byte_chr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var i int
+	if err := UnpackPositionalArgs("byte_chr", args, kwargs, 1, &i); err != nil {
+		return nil, err
 	}
-	elems := make([]Value, len(names))
-	for i, name := range names {
-		elems[i] = String(name)
+	if i < 0 || i > 0xFF {
+		return nil, fmt.Errorf("byte_chr: byte value %d out of range (want 0-255)", i)
 	}
-	return NewList(elems), nil
+	return String([]byte{byte(i)}), nil
 }
 
-// https://github.com/google/skylark/blob/master/doc/spec.md#enumerate
-func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	var iterable Iterable
-	var start int
-	if err := UnpackPositionalArgs("enumerate", args, kwargs, 1, &iterable, &start); err != nil {
+// https://github.com/google/skylark/blob/master/doc/spec.md#byte_ord
+func byte_ord(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var s string
+	if err := UnpackPositionalArgs("byte_ord", args, kwargs, 1, &s); err != nil {
 		return nil, err
 	}
-
-	iter := iterable.Iterate()
-	if iter == nil {
-		return nil, fmt.Errorf("enumerate: got %s, want iterable", iterable.Type())
+	if len(s) != 1 {
+		return nil, fmt.Errorf("byte_ord: string has %d bytes, want 1", len(s))
 	}
-	defer iter.Done()
+	return MakeInt(int(s[0])), nil
+}
 
-	var pairs []Value
+// https://github.com/google/skylark/blob/master/doc/spec.md#cache_key
+func cache_key(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var x Value
+	if err := UnpackPositionalArgs("cache_key", args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := writeCacheKey(&buf, x, nil); err != nil {
+		return nil, fmt.Errorf("cache_key: %v", err)
+	}
+	return String(buf.String()), nil
+}
 
-	if n := Len(iterable); n >= 0 {
-		// common case: known length
-		pairs = make([]Value, 0, n)
-		array := make(Tuple, 2*n) // allocate a single backing array
-		for i := 0; iter.Next(&x); i++ {
-			pair := array[:2:2]
-			array = array[2:]
-			pair[0] = MakeInt(start + i)
-			pair[1] = x
-			pairs = append(pairs, pair)
+// writeCacheKey writes the canonical encoding of x to out.
+// path contains the containers enclosing x, for cycle detection.
+func writeCacheKey(out *bytes.Buffer, x Value, path []Value) error {
+	// Only mutable containers can form cycles. Tuples are not
+	// added to path: they are uncomparable slices.
+	switch x.(type) {
+	case *List, *Dict, *Set:
+		if pathContains(path, x) {
+			return fmt.Errorf("cannot encode cyclic %s", x.Type())
 		}
-	} else {
-		// non-sequence (unknown length)
-		for i := 0; iter.Next(&x); i++ {
-			pair := Tuple{MakeInt(start + i), x}
-			pairs = append(pairs, pair)
+	}
+
+	// encodeAll returns the encodings of the elements of seq.
+	encodeAll := func(seq []Value) ([]string, error) {
+		path := path
+		if _, ok := x.(Tuple); !ok {
+			path = append(path, x)
+		}
+		keys := make([]string, len(seq))
+		for i, elem := range seq {
+			var buf bytes.Buffer
+			if err := writeCacheKey(&buf, elem, path); err != nil {
+				return nil, err
+			}
+			keys[i] = buf.String()
 		}
+		return keys, nil
 	}
 
-	return NewList(pairs), nil
-}
+	switch x := x.(type) {
+	case NoneType, Bool, Int, String:
+		out.WriteString(x.String())
 
-func float(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	if len(kwargs) > 0 {
-		return nil, fmt.Errorf("float does not accept keyword arguments")
-	}
-	if len(args) == 0 {
-		return Float(0.0), nil
-	}
-	if len(args) != 1 {
-		return nil, fmt.Errorf("float got %d arguments, wants 1", len(args))
-	}
-	switch x := args[0].(type) {
-	case Bool:
-		if x {
-			return Float(1.0), nil
-		} else {
-			return Float(0.0), nil
-		}
-	case Int:
-		return x.Float(), nil
 	case Float:
-		return x, nil
-	case String:
-		f, err := strconv.ParseFloat(string(x), 64)
+		// The type tag distinguishes float(1) from 1.
+		fmt.Fprintf(out, "float(%s)", strconv.FormatFloat(float64(x), 'g', -1, 64))
+
+	case *List:
+		elems, err := encodeAll(x.elems)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return Float(f), nil
-	default:
-		return nil, fmt.Errorf("float got %s, want number or string", x.Type())
-	}
-}
+		fmt.Fprintf(out, "[%s]", strings.Join(elems, ", "))
 
-// https://github.com/google/skylark/blob/master/doc/spec.md#getattr
-func getattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	var object, dflt Value
-	var name string
-	if err := UnpackPositionalArgs("getattr", args, kwargs, 2, &object, &name, &dflt); err != nil {
-		return nil, err
-	}
+	case Tuple:
+		elems, err := encodeAll(x)
+		if err != nil {
+			return err
+		}
+		out.WriteByte('(')
+		out.WriteString(strings.Join(elems, ", "))
+		if len(elems) == 1 {
+			out.WriteByte(',')
+		}
+		out.WriteByte(')')
+
+	case *Dict:
+		items := x.Items()
+		flat := make([]Value, 0, 2*len(items))
+		for _, item := range items {
+			flat = append(flat, item[0], item[1])
+		}
+		enc, err := encodeAll(flat)
+		if err != nil {
+			return err
+		}
+		entries := make([]string, len(items))
+		for i := range items {
+			entries[i] = enc[2*i] + ": " + enc[2*i+1]
+		}
+		sort.Strings(entries) // canonical order, independent of insertion
+		fmt.Fprintf(out, "{%s}", strings.Join(entries, ", "))
+
+	case *Set:
+		elems, err := encodeAll(x.elems())
+		if err != nil {
+			return err
+		}
+		sort.Strings(elems)
+		fmt.Fprintf(out, "set([%s])", strings.Join(elems, ", "))
+
+	default:
+		return fmt.Errorf("cannot encode %s", x.Type())
+	}
+	return nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#caller_location
+func caller_location(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs("caller_location", args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	// thread.Caller() is the function that called caller_location;
+	// its parent is the function that called it.
+	fr := thread.Caller()
+	if fr == nil || fr.parent == nil {
+		return None, nil // called from module toplevel
+	}
+	posn := fr.parent.Position()
+	return String(fmt.Sprintf("%s:%d", posn.Filename(), posn.Line)), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#chr
+func chr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("chr does not accept keyword arguments")
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("chr: got %d arguments, want 1", len(args))
+	}
+	i, err := AsInt32(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("chr: got %s, want int", args[0].Type())
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("chr: Unicode code point %d out of range (<0)", i)
+	}
+	if i > unicode.MaxRune {
+		return nil, fmt.Errorf("chr: Unicode code point U+%X out of range (>0x10FFFF)", i)
+	}
+	return String(string(i)), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#command_line
+func command_line(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var iterable Iterable
+	quote := true
+	sep := " "
+	if err := UnpackArgs("command_line", args, kwargs, "args", &iterable, "quote?", &quote, "sep?", &sep); err != nil {
+		return nil, err
+	}
+	iter := IterateThread(thread, iterable)
+	defer iter.Done()
+	var buf bytes.Buffer
+	var x Value
+	for i := 0; iter.Next(&x); i++ {
+		s, ok := AsString(x)
+		if !ok {
+			return nil, fmt.Errorf("command_line: in args, got %s, want string", x.Type())
+		}
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		if quote {
+			s = shellQuote(s)
+		}
+		buf.WriteString(s)
+	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
+	return String(buf.String()), nil
+}
+
+// shellQuote returns s quoted, if necessary, so that a POSIX shell
+// interprets it as a single word with the value s.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for i := 0; i < len(s); i++ {
+		if !isShellSafe(s[i]) {
+			return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+		}
+	}
+	return s
+}
+
+// isShellSafe reports whether the byte b need not be quoted in a shell word.
+func isShellSafe(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' ||
+		strings.IndexByte("@%+=:,./_-", b) >= 0
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#deep_isclose
+func deep_isclose(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x, y Value
+	var relTol float64 = 1e-9
+	if err := UnpackArgs("deep_isclose", args, kwargs, "a", &x, "b", &y, "rel_tol?", &relTol); err != nil {
+		return nil, err
+	}
+	if relTol < 0 {
+		return nil, fmt.Errorf("deep_isclose: rel_tol must be non-negative")
+	}
+	ok, err := isclose(x, y, relTol, maxdepth)
+	if err != nil {
+		return nil, fmt.Errorf("deep_isclose: %v", err)
+	}
+	return Bool(ok), nil
+}
+
+// isclose reports whether x and y are structurally equal, treating
+// numbers as equal if they differ by no more than relTol times the
+// larger of their magnitudes, when either of them is a float.
+func isclose(x, y Value, relTol float64, depth int) (bool, error) {
+	if depth < 1 {
+		return false, fmt.Errorf("comparison exceeded maximum recursion depth")
+	}
+	switch x := x.(type) {
+	case Int, Float:
+		_, xf := x.(Float)
+		_, yf := y.(Float)
+		if !xf && !yf {
+			break // exact comparison of ints
+		}
+		switch y.(type) {
+		case Int, Float:
+		default:
+			return false, nil
+		}
+		a, _ := toFloat(x)
+		b, _ := toFloat(y)
+		if a == b {
+			return true, nil // includes infinities
+		}
+		diff := math.Abs(float64(a - b))
+		return diff <= relTol*math.Max(math.Abs(float64(a)), math.Abs(float64(b))), nil
+	case *List:
+		if y, ok := y.(*List); ok {
+			return iscloseSeq(x.elems, y.elems, relTol, depth)
+		}
+		return false, nil
+	case Tuple:
+		if y, ok := y.(Tuple); ok {
+			return iscloseSeq(x, y, relTol, depth)
+		}
+		return false, nil
+	case *Dict:
+		y, ok := y.(*Dict)
+		if !ok || x.Len() != y.Len() {
+			return false, nil
+		}
+		for _, item := range x.Items() {
+			yv, found, err := y.Get(item[0])
+			if err != nil || !found {
+				return false, err
+			}
+			if ok, err := isclose(item[1], yv, relTol, depth-1); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return EqualDepth(x, y, depth)
+}
+
+func iscloseSeq(x, y []Value, relTol float64, depth int) (bool, error) {
+	if len(x) != len(y) {
+		return false, nil
+	}
+	for i := range x {
+		if ok, err := isclose(x[i], y[i], relTol, depth-1); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#dict
+func dict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("dict: got %d arguments, want at most 1", len(args))
+	}
+	dict := new(Dict)
+	if err := updateDict(thread, dict, args, kwargs); err != nil {
+		return nil, fmt.Errorf("dict: %v", err)
+	}
+	return dict, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#desc
+func desc(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var key Callable
+	if err := UnpackPositionalArgs("desc", args, kwargs, 1, &key); err != nil {
+		return nil, err
+	}
+	return &descending{key: key}, nil
+}
+
+// A descending is a function returned by desc.
+// It wraps the result of its key function in a reversedKey.
+type descending struct {
+	key Callable
+}
+
+var _ Callable = (*descending)(nil)
+
+func (d *descending) Name() string          { return "desc" }
+func (d *descending) String() string        { return fmt.Sprintf("<desc %s>", d.key) }
+func (d *descending) Type() string          { return "desc" }
+func (d *descending) Freeze()               { d.key.Freeze() }
+func (d *descending) Truth() Bool           { return True }
+func (d *descending) Hash() (uint32, error) { return d.key.Hash() }
+
+func (d *descending) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	v, err := Call(thread, d.key, args, kwargs)
+	if err != nil {
+		return nil, err // to preserve backtrace, don't modify error
+	}
+	return reversedKey{v}, nil
+}
+
+// A reversedKey is a sort key that orders in the opposite direction
+// to the value it wraps.
+type reversedKey struct {
+	v Value
+}
+
+var _ Comparable = reversedKey{}
+
+func (k reversedKey) String() string        { return fmt.Sprintf("desc(%s)", k.v) }
+func (k reversedKey) Type() string          { return "reversed_key" }
+func (k reversedKey) Freeze()               { k.v.Freeze() }
+func (k reversedKey) Truth() Bool           { return True }
+func (k reversedKey) Hash() (uint32, error) { return k.v.Hash() }
+
+func (x reversedKey) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	// Swapping the operands reverses the order.
+	return CompareDepth(op, y.(reversedKey).v, x.v, depth-1)
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#describe
+func describe(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	if err := UnpackPositionalArgs("describe", args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+
+	var attrs, callables []Value
+	if x, ok := x.(HasAttrs); ok {
+		for _, name := range x.AttrNames() {
+			attrs = append(attrs, String(name))
+			v, err := x.Attr(name)
+			if err != nil {
+				return nil, fmt.Errorf("describe: %s.%s: %v", x.Type(), name, err)
+			}
+			if _, ok := v.(Callable); ok {
+				callables = append(callables, String(name))
+			}
+		}
+	}
+
+	result := new(Dict)
+	result.Set(String("type"), String(x.Type()))
+	result.Set(String("attrs"), NewList(attrs))
+	result.Set(String("callable"), NewList(callables))
+	return result, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#dir
+func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("dir does not accept keyword arguments")
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("dir: got %d arguments, want 1", len(args))
+	}
+
+	var names []string
+	if x, ok := args[0].(HasAttrs); ok {
+		names = x.AttrNames()
+	}
+	elems := make([]Value, len(names))
+	for i, name := range names {
+		elems[i] = String(name)
+	}
+	return NewList(elems), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#enum
+func enum(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("enum: unexpected positional arguments")
+	}
+	e := &enumValue{fields: make(StringDict, len(kwargs))}
+	for _, kwarg := range kwargs {
+		name := string(kwarg[0].(String))
+		if enumMethods[name] != nil {
+			return nil, fmt.Errorf("enum: field name %s conflicts with method", name)
+		}
+		kwarg[1].Freeze()
+		e.names = append(e.names, name)
+		e.fields[name] = kwarg[1]
+	}
+	return e, nil
+}
+
+// An enumValue is an immutable value returned by enum.
+type enumValue struct {
+	names  []string // in order of declaration
+	fields StringDict
+}
+
+var _ HasAttrs = (*enumValue)(nil)
+
+func (e *enumValue) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("enum(")
+	for i, name := range e.names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(name)
+		buf.WriteString(" = ")
+		writeValue(&buf, e.fields[name], nil)
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+func (e *enumValue) Type() string          { return "enum" }
+func (e *enumValue) Freeze()               {} // immutable
+func (e *enumValue) Shareable()            {} // fields are frozen by enum
+func (e *enumValue) Truth() Bool           { return True }
+func (e *enumValue) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: enum") }
+
+func (e *enumValue) Attr(name string) (Value, error) {
+	if v, ok := e.fields[name]; ok {
+		return v, nil
+	}
+	return builtinAttr(e, name, enumMethods)
+}
+
+func (e *enumValue) AttrNames() []string {
+	names := append(builtinAttrNames(enumMethods), e.names...)
+	sort.Strings(names)
+	return names
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#enumerate
+func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var iterable Iterable
+	var start int
+	if err := UnpackPositionalArgs("enumerate", args, kwargs, 1, &iterable, &start); err != nil {
+		return nil, err
+	}
+
+	iter := IterateThread(thread, iterable)
+	if iter == nil {
+		return nil, fmt.Errorf("enumerate: got %s, want iterable", iterable.Type())
+	}
+	defer iter.Done()
+
+	var pairs []Value
+	var x Value
+
+	if n := Len(iterable); n >= 0 {
+		// common case: known length
+		if err := thread.alloc(3 * uint64(n)); err != nil {
+			return nil, err // each pair is a list element and a 2-tuple
+		}
+		pairs = make([]Value, 0, n)
+		array := make(Tuple, 2*n) // allocate a single backing array
+		for i := 0; iter.Next(&x); i++ {
+			pair := array[:2:2]
+			array = array[2:]
+			pair[0] = MakeInt(start + i)
+			pair[1] = x
+			pairs = append(pairs, pair)
+		}
+	} else {
+		// non-sequence (unknown length)
+		for i := 0; iter.Next(&x); i++ {
+			if err := thread.alloc(3); err != nil {
+				return nil, err
+			}
+			pair := Tuple{MakeInt(start + i), x}
+			pairs = append(pairs, pair)
+		}
+	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
+
+	return NewList(pairs), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#enumerate_items
+func enumerate_items(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var d *Dict
+	var start int
+	if err := UnpackArgs("enumerate_items", args, kwargs, "dict", &d, "start?", &start); err != nil {
+		return nil, err
+	}
+	items := d.Items()
+	triples := make([]Value, len(items))
+	for i, item := range items {
+		triples[i] = Tuple{MakeInt(start + i), item[0], item[1]}
+	}
+	return NewList(triples), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#escape
+func escape(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var s string
+	if err := UnpackPositionalArgs("escape", args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&buf, `\x%02x`, s[i]) // invalid UTF-8
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\a':
+			buf.WriteString(`\a`)
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r == '\v':
+			buf.WriteString(`\v`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&buf, `\x%02x`, r)
+		default:
+			buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return String(buf.String()), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#expect_type
+func expect_type(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x, want Value
+	if err := UnpackPositionalArgs("expect_type", args, kwargs, 2, &x, &want); err != nil {
+		return nil, err
+	}
+	var names []string
+	switch want := want.(type) {
+	case String:
+		names = []string{string(want)}
+	case Tuple:
+		if len(want) == 0 {
+			return nil, fmt.Errorf("expect_type: empty tuple of type names")
+		}
+		for _, name := range want {
+			s, ok := AsString(name)
+			if !ok {
+				return nil, fmt.Errorf("expect_type: got %s in type names, want string", name.Type())
+			}
+			names = append(names, s)
+		}
+	default:
+		return nil, fmt.Errorf("expect_type: for parameter 2: got %s, want string or tuple", want.Type())
+	}
+	for _, name := range names {
+		if name == x.Type() {
+			return x, nil
+		}
+	}
+	return nil, fmt.Errorf("expect_type: expected %s, got %s", strings.Join(names, " or "), x.Type())
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#fail
+func fail(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	sep := " "
+	if err := UnpackArgs("fail", args, kwargs, "*args", &args, "sep?", &sep); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("fail: ")
+	path := make([]Value, 0, 4)
+	for i, v := range args {
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		if s, ok := AsString(v); ok {
+			buf.WriteString(s)
+		} else {
+			writeValue(&buf, v, path)
+		}
+	}
+	return nil, errors.New(buf.String())
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#filter
+func filter(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var function Value
+	var iterable Iterable
+	if err := UnpackPositionalArgs("filter", args, kwargs, 2, &function, &iterable); err != nil {
+		return nil, err
+	}
+	var pred Callable
+	switch function := function.(type) {
+	case NoneType:
+		// filter(None, x) keeps the elements of x that are true.
+	case Callable:
+		pred = function
+	default:
+		return nil, fmt.Errorf("filter: for parameter 1: got %s, want callable or None", function.Type())
+	}
+	// No length hint: the result may be much shorter than the operand.
+	// The predicate is called by the iterating thread, which
+	// need not be the thread that called filter.
+	return NewFailableGenerator("filter", func(thread *Thread) (func() (Value, bool, error), func()) {
+		if thread == nil && pred != nil {
+			return noThread("filter"), nil
+		}
+		iter := IterateThread(thread, iterable)
+		next := func() (Value, bool, error) {
+			var x Value
+			for iter.Next(&x) {
+				keep := x
+				if pred != nil {
+					v, err := Call(thread, pred, Tuple{x}, nil)
+					if err != nil {
+						return nil, false, err // to preserve backtrace, don't modify error
+					}
+					keep = v
+				}
+				if keep.Truth() {
+					return x, true, nil
+				}
+			}
+			return nil, false, IterErr(iter)
+		}
+		return next, iter.Done
+	}), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#filter_items
+func filter_items(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var d *Dict
+	var pred Callable
+	if err := UnpackArgs("filter_items", args, kwargs, "dict", &d, "pred", &pred); err != nil {
+		return nil, err
+	}
+	result := new(Dict)
+	for _, item := range d.Items() {
+		ok, err := Call(thread, pred, item, nil)
+		if err != nil {
+			return nil, err // to preserve backtrace, don't modify error
+		}
+		if ok.Truth() {
+			result.SetKey(item[0], item[1]) // can't fail
+		}
+	}
+	return result, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#flatten_dict
+func flatten_dict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var d *Dict
+	sep := "."
+	if err := UnpackArgs("flatten_dict", args, kwargs, "dict", &d, "sep?", &sep); err != nil {
+		return nil, err
+	}
+	result := new(Dict)
+	if err := flattenDict(result, d, "", sep, nil); err != nil {
+		return nil, fmt.Errorf("flatten_dict: %v", err)
+	}
+	return result, nil
+}
+
+// flattenDict inserts into result an item for each leaf of d,
+// whose key is the concatenation of prefix and the path to the leaf.
+// path holds the dicts enclosing d, for cycle detection.
+func flattenDict(result, d *Dict, prefix, sep string, path []*Dict) error {
+	for _, p := range path {
+		if p == d {
+			return fmt.Errorf("cycle in dict")
+		}
+	}
+	path = append(path, d)
+	for _, item := range d.Items() {
+		k, ok := AsString(item[0])
+		if !ok {
+			return fmt.Errorf("got %s key, want string", item[0].Type())
+		}
+		key := prefix + k
+		if sub, ok := item[1].(*Dict); ok && sub.Len() > 0 {
+			if err := flattenDict(result, sub, key+sep, sep, path); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, found, _ := result.Get(String(key)); found {
+			return fmt.Errorf("duplicate key %q", key)
+		}
+		if err := result.SetKey(String(key), item[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func float(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("float does not accept keyword arguments")
+	}
+	if len(args) == 0 {
+		return Float(0.0), nil
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("float got %d arguments, wants 1", len(args))
+	}
+	switch x := args[0].(type) {
+	case Bool:
+		if x {
+			return Float(1.0), nil
+		} else {
+			return Float(0.0), nil
+		}
+	case Int:
+		return x.Float(), nil
+	case Float:
+		return x, nil
+	case String:
+		return parseFloat(string(x))
+	default:
+		return nil, fmt.Errorf("float got %s, want number or string", x.Type())
+	}
+}
+
+// parseFloat parses a string as a float.  In addition to decimal
+// literals, it accepts "inf", "infinity", and "nan", in any case and
+// with an optional sign.
+func parseFloat(s string) (Value, error) {
+	t := s
+	neg := false
+	if t != "" && (t[0] == '+' || t[0] == '-') {
+		neg = t[0] == '-'
+		t = t[1:]
+	}
+	switch strings.ToLower(t) {
+	case "inf", "infinity":
+		if neg {
+			return Float(math.Inf(-1)), nil
+		}
+		return Float(math.Inf(+1)), nil
+	case "nan":
+		return Float(math.NaN()), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return Float(f), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#freeze_dict
+func freeze_dict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var d *Dict
+	var inPlace bool
+	if err := UnpackArgs("freeze_dict", args, kwargs, "d", &d, "in_place?", &inPlace); err != nil {
+		return nil, err
+	}
+	if inPlace {
+		d.Freeze()
+		return d, nil
+	}
+	// Copy deeply so that freezing the result
+	// does not freeze values shared with d.
+	y, err := frozenCopy(d)
+	if err != nil {
+		return nil, fmt.Errorf("freeze_dict: %v", err)
+	}
+	return y, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#frozen_copy
+func frozen_copy(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	if err := UnpackPositionalArgs("frozen_copy", args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	y, err := frozenCopy(x)
+	if err != nil {
+		return nil, fmt.Errorf("frozen_copy: %v", err)
+	}
+	return y, nil
+}
+
+// frozenCopy returns a frozen deep copy of x.  It fails if x contains
+// a value that is not copied, such as a function, unless that value is
+// immutable, since freezing the copy would freeze the original too.
+func frozenCopy(x Value) (Value, error) {
+	var bad Value
+	c := deepCopier{
+		copies: make(map[Value]Value),
+		shared: func(v Value) {
+			if bad == nil && !isImmutable(v) {
+				bad = v
+			}
+		},
+	}
+	y := c.copy(x)
+	if bad != nil {
+		return nil, fmt.Errorf("cannot copy %s", bad.Type())
+	}
+	y.Freeze()
+	return y, nil
+}
+
+// isImmutable reports whether x is a value that freezing cannot
+// affect, and so may be shared by a frozen copy.
+func isImmutable(x Value) bool {
+	switch x := x.(type) {
+	case NoneType, Bool, Int, Float, String, rangeValue:
+		return true
+	case *Builtin:
+		return x.recv == nil || isImmutable(x.recv)
+	case Shareable:
+		return true
+	}
+	return false
+}
+
+// Clone returns a deep copy of v, for example to obtain a mutable
+// version of a frozen value.  Each list, dict, and set reachable from v
+// through lists, tuples, dicts, sets, and Cloner values such as structs
+// is replaced by a new, unfrozen one.  Values of other types, such as
+// strings and numbers, are shared with v.
+// Cycles and shared substructure are preserved, except that a Cloner
+// that is reachable from itself is copied again within its own copy.
+func Clone(v Value) Value { return deepCopy(v) }
+
+// deepCopy returns a copy of x in which each list, dict, and set
+// reachable from x through lists, tuples, dicts, sets, and Cloners is
+// replaced by a new one.  Values of other types are shared with x.
+// Cycles and shared substructure are preserved, as described at Clone.
+func deepCopy(x Value) Value {
+	return deepCopier{copies: make(map[Value]Value)}.copy(x)
+}
+
+// A deepCopier maps each list, dict, set, and Cloner already copied
+// to its copy.
+// If shared is non-nil, it is called for each value that is shared
+// with the original because it is not copied.
+type deepCopier struct {
+	copies map[Value]Value
+	shared func(Value)
+}
+
+func (c deepCopier) copy(x Value) Value {
+	switch x := x.(type) {
+	case *List:
+		if y, ok := c.copies[x]; ok {
+			return y
+		}
+		y := NewList(make([]Value, len(x.elems)))
+		c.copies[x] = y
+		for i, elem := range x.elems {
+			y.elems[i] = c.copy(elem)
+		}
+		return y
+	case Tuple:
+		y := make(Tuple, len(x))
+		for i, elem := range x {
+			y[i] = c.copy(elem)
+		}
+		return y
+	case *Dict:
+		if y, ok := c.copies[x]; ok {
+			return y
+		}
+		y := new(Dict)
+		c.copies[x] = y
+		for _, item := range x.Items() {
+			y.SetKey(c.copy(item[0]), c.copy(item[1])) // can't fail
+		}
+		return y
+	case *Set:
+		if y, ok := c.copies[x]; ok {
+			return y
+		}
+		y := new(Set)
+		c.copies[x] = y
+		for _, elem := range x.elems() {
+			y.Insert(c.copy(elem)) // can't fail
+		}
+		return y
+	case Cloner:
+		// Memoize the copy of a Cloner with identity, so that one
+		// reachable by several paths is copied once.  Only pointers
+		// are safe as map keys: a comparable struct may still hold
+		// a slice in an interface field.  The copy is recorded only
+		// once Clone returns, so a cycle back to x copies it again.
+		isPtr := reflect.ValueOf(x).Kind() == reflect.Ptr
+		if isPtr {
+			if y, ok := c.copies[x]; ok {
+				return y
+			}
+		}
+		y := x.Clone(c.copy)
+		if isPtr {
+			c.copies[x] = y
+		}
+		return y
+	}
+	if c.shared != nil {
+		c.shared(x)
+	}
+	return x
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#getattr
+func getattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var object, dflt Value
+	var name string
+	if err := UnpackPositionalArgs("getattr", args, kwargs, 2, &object, &name, &dflt); err != nil {
+		return nil, err
+	}
 	if object, ok := object.(HasAttrs); ok {
 		v, err := object.Attr(name)
 		if err != nil {
 			// An error could mean the field doesn't exist,
 			// or it exists but could not be computed.
-			if dflt != nil {
+			// Only the former is masked by a default.
+			if dflt != nil && !isAttrName(object, name) {
 				return dflt, nil
 			}
 			return nil, err
@@ -537,6 +1874,31 @@ func getattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	return nil, fmt.Errorf("%s has no .%s field or method", object.Type(), name)
 }
 
+// https://github.com/google/skylark/blob/master/doc/spec.md#globals
+func globals(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs("globals", args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	fr := thread.Caller()
+	if fr == nil {
+		return nil, fmt.Errorf("globals: not called from Skylark code")
+	}
+	fn, ok := fr.Callable().(*Function)
+	if !ok {
+		return nil, fmt.Errorf("globals: not called from Skylark code")
+	}
+	result := new(Dict)
+	for i, id := range fn.funcode.Prog.Globals {
+		if v := fn.globals[i]; v != nil {
+			result.SetKey(String(id.Name), v) // can't fail
+		}
+	}
+	// Make the snapshot read-only without freezing the values,
+	// which belong to the module.
+	result.ht.frozen = true
+	return result, nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#hasattr
 func hasattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var object Value
@@ -552,17 +1914,26 @@ func hasattr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, err
 
 		// An error does not conclusively indicate presence or
 		// absence of a field: it could occur while computing
-		// the value of a present attribute, or it could be a
-		// "no such attribute" error with details.
-		for _, x := range object.AttrNames() {
-			if x == name {
-				return True, nil
-			}
+		// the value of a present attribute, in which case
+		// hasattr fails too, or it could be a "no such
+		// attribute" error with details.
+		if isAttrName(object, name) {
+			return nil, err
 		}
 	}
 	return False, nil
 }
 
+// isAttrName reports whether name is among the attribute names of x.
+func isAttrName(x HasAttrs, name string) bool {
+	for _, n := range x.AttrNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#hash
 func hash(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var x Value
@@ -573,6 +1944,89 @@ func hash(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	return MakeUint(uint(h)), err
 }
 
+// https://github.com/google/skylark/blob/master/doc/spec.md#id
+func id(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	if err := UnpackPositionalArgs("id", args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	// Values of reference type are identified by their address,
+	// which is stable because the garbage collector does not move
+	// objects.  Hashable immutable values are numbered -1, -2, ...
+	// in order of their first use by the thread, so that equal
+	// values of the same type have equal ids and others never
+	// collide.  The thread retains each such value for its lifetime.
+	v := reflect.ValueOf(x)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return MakeUint64(uint64(v.Pointer())), nil
+	}
+	if _, err := x.Hash(); err == nil {
+		if thread.valueIDs == nil {
+			thread.valueIDs = new(Dict)
+		}
+		if id, found, _ := thread.valueIDs.Get(idKey{x}); found {
+			return id, nil
+		}
+		id := MakeInt(-1 - thread.valueIDs.Len())
+		thread.valueIDs.SetKey(idKey{x}, id) // can't fail
+		return id, nil
+	}
+	if v.Kind() == reflect.Slice && v.Len() > 0 {
+		return MakeUint64(uint64(v.Pointer())), nil // e.g. a tuple containing a list
+	}
+	return nil, fmt.Errorf("id: no identity for %s value", x.Type())
+}
+
+// An idKey is the key of a hashable immutable value in the table
+// of ids.  Two keys are equal only if their values are identical.
+type idKey struct{ x Value }
+
+var _ Comparable = idKey{}
+
+func (k idKey) String() string        { return k.x.String() }
+func (k idKey) Type() string          { return "idKey" }
+func (k idKey) Freeze()               {}
+func (k idKey) Truth() Bool           { return True }
+func (k idKey) Hash() (uint32, error) { return k.x.Hash() }
+
+func (k idKey) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
+	switch op {
+	case syntax.EQL:
+		return identical(k.x, y.(idKey).x)
+	case syntax.NEQ:
+		eq, err := identical(k.x, y.(idKey).x)
+		return !eq, err
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", k.Type(), op, y.Type())
+}
+
+// identical reports whether x and y are equal values of the same
+// type, element-wise for tuples.  Unlike Equal, it distinguishes
+// 1 from 1.0, and treats NaN as identical to itself.
+func identical(x, y Value) (bool, error) {
+	if reflect.TypeOf(x) != reflect.TypeOf(y) {
+		return false, nil
+	}
+	switch x := x.(type) {
+	case Float:
+		y := y.(Float)
+		return x == y || x != x && y != y, nil
+	case Tuple:
+		y := y.(Tuple)
+		if len(x) != len(y) {
+			return false, nil
+		}
+		for i := range x {
+			if eq, err := identical(x[i], y[i]); err != nil || !eq {
+				return eq, err
+			}
+		}
+		return true, nil
+	}
+	return Equal(x, y)
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#int
 func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var x Value = zero
@@ -665,12 +2119,48 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			return zero, nil
 		}
 	}
-
-	i, err := NumberToInt(x)
-	if err != nil {
-		return nil, fmt.Errorf("int: %s", err)
+
+	i, err := NumberToInt(x)
+	if err != nil {
+		return nil, fmt.Errorf("int: %s", err)
+	}
+	return i, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#is_hashable
+func is_hashable(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	if err := UnpackPositionalArgs("is_hashable", args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	_, err := x.Hash()
+	return Bool(err == nil), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#is_type
+func is_type(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	var names Iterable
+	if err := UnpackPositionalArgs("is_type", args, kwargs, 2, &x, &names); err != nil {
+		return nil, err
+	}
+	iter := IterateThread(thread, names)
+	defer iter.Done()
+	found := false
+	var name Value
+	for iter.Next(&name) {
+		s, ok := AsString(name)
+		if !ok {
+			return nil, fmt.Errorf("is_type: got %s in names, want string", name.Type())
+		}
+		if s == x.Type() {
+			found = true
+		}
+	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
 	}
-	return i, nil
+	return Bool(found), nil
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#len
@@ -693,20 +2183,208 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		return nil, err
 	}
 	var elems []Value
-	if iterable != nil {
-		iter := iterable.Iterate()
-		defer iter.Done()
-		if n := Len(iterable); n > 0 {
-			elems = make([]Value, 0, n) // preallocate if length known
+	switch x := iterable.(type) {
+	case Tuple:
+		// fast path: copy the backing array in one operation
+		if err := thread.alloc(uint64(len(x))); err != nil {
+			return nil, err
 		}
-		var x Value
-		for iter.Next(&x) {
-			elems = append(elems, x)
+		elems = append([]Value(nil), x...)
+	case *List:
+		if err := thread.alloc(uint64(len(x.elems))); err != nil {
+			return nil, err
+		}
+		elems = append([]Value(nil), x.elems...)
+	case nil:
+		// list() => []
+	default:
+		var err error
+		if elems, err = collect(thread, iterable); err != nil {
+			return nil, err
 		}
 	}
 	return NewList(elems), nil
 }
 
+// collect returns the elements of iterable in a new slice, adding
+// each one to the thread's allocation count.
+func collect(thread *Thread, iterable Iterable) ([]Value, error) {
+	iter := IterateThread(thread, iterable)
+	defer iter.Done()
+	var elems []Value
+	n := lenHint(iterable)
+	if n > 0 {
+		if err := thread.alloc(uint64(n)); err != nil {
+			return nil, err
+		}
+		elems = make([]Value, 0, n) // preallocate if length known
+	}
+	var elem Value
+	for iter.Next(&elem) {
+		if len(elems) >= n {
+			if err := thread.alloc(1); err != nil {
+				return nil, err
+			}
+		}
+		elems = append(elems, elem)
+	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
+	return elems, nil
+}
+
+// noThread returns the next function of a generator that cannot be
+// iterated because the iteration was started without a thread.
+func noThread(name string) func() (Value, bool, error) {
+	return func() (Value, bool, error) {
+		return nil, false, fmt.Errorf("%s: cannot iterate without a thread", name)
+	}
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#map
+func map_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("map does not accept keyword arguments")
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("map: got %d arguments, want at least 2", len(args))
+	}
+	fn, ok := args[0].(Callable)
+	if !ok {
+		return nil, fmt.Errorf("map: for parameter 1: got %s, want callable", args[0].Type())
+	}
+	iterables := make([]Iterable, len(args)-1)
+	hint := -1 // least estimated length
+	for i, x := range args[1:] {
+		iterable, ok := x.(Iterable)
+		if !ok {
+			return nil, fmt.Errorf("map: argument #%d is not iterable: %s", i+2, x.Type())
+		}
+		iterables[i] = iterable
+		if h := lenHint(x); h >= 0 && (hint < 0 || h < hint) {
+			hint = h
+		}
+	}
+	// The function is called by the iterating thread, which
+	// need not be the thread that called map.
+	gen := NewFailableGenerator("map", func(thread *Thread) (func() (Value, bool, error), func()) {
+		if thread == nil {
+			return noThread("map"), nil
+		}
+		iters := make([]Iterator, len(iterables))
+		for i, iterable := range iterables {
+			iters[i] = IterateThread(thread, iterable)
+		}
+		next := func() (Value, bool, error) {
+			fnargs := make(Tuple, len(iters))
+			for i, iter := range iters {
+				if !iter.Next(&fnargs[i]) {
+					return nil, false, IterErr(iter) // shortest operand is exhausted
+				}
+			}
+			v, err := Call(thread, fn, fnargs, nil)
+			if err != nil {
+				return nil, false, err // to preserve backtrace, don't modify error
+			}
+			return v, true, nil
+		}
+		done := func() {
+			for _, iter := range iters {
+				iter.Done()
+			}
+		}
+		return next, done
+	})
+	if hint >= 0 {
+		gen = gen.WithLenHint(hint)
+	}
+	return gen, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#match
+func match(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var value, deflt Value
+	var cases *Dict
+	if err := UnpackArgs("match", args, kwargs, "value", &value, "cases", &cases, "default?", &deflt); err != nil {
+		return nil, err
+	}
+	result, found, err := cases.Get(value)
+	if err != nil {
+		return nil, fmt.Errorf("match: %v", err)
+	}
+	if !found {
+		if deflt == nil {
+			return None, nil
+		}
+		result = deflt
+	}
+	// A callable result is called only if selected.
+	if fn, ok := result.(Callable); ok {
+		return Call(thread, fn, nil, nil)
+	}
+	return result, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#memoize
+func memoize(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var fn Callable
+	if err := UnpackPositionalArgs("memoize", args, kwargs, 1, &fn); err != nil {
+		return nil, err
+	}
+	return &memoized{fn: fn}, nil
+}
+
+// A memoized is a function returned by memoize.
+// Its results are cached by each thread that calls it.
+type memoized struct {
+	fn Callable
+}
+
+var _ Callable = (*memoized)(nil)
+
+func (m *memoized) Name() string          { return m.fn.Name() }
+func (m *memoized) String() string        { return fmt.Sprintf("<memoized %s>", m.fn) }
+func (m *memoized) Type() string          { return "memoized" }
+func (m *memoized) Freeze()               { m.fn.Freeze() }
+func (m *memoized) Truth() Bool           { return True }
+func (m *memoized) Hash() (uint32, error) { return m.fn.Hash() }
+
+func (m *memoized) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	// The cache key is the pair (args, kwargs), with kwargs sorted by name.
+	pairs := make(Tuple, len(kwargs))
+	for i, pair := range kwargs {
+		pairs[i] = pair
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].(Tuple)[0].(String) < pairs[j].(Tuple)[0].(String)
+	})
+	key := Tuple{args, pairs}
+
+	if thread.memoCaches == nil {
+		thread.memoCaches = make(map[*memoized]*Dict)
+	}
+	cache := thread.memoCaches[m]
+	if cache == nil {
+		cache = new(Dict)
+		thread.memoCaches[m] = cache
+	}
+
+	if result, found, err := cache.Get(key); err != nil {
+		return nil, fmt.Errorf("memoized %s: %v", m.Name(), err)
+	} else if found {
+		return result, nil
+	}
+	result, err := Call(thread, m.fn, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.Set(key, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#min
 func minmax(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) == 0 {
@@ -728,13 +2406,16 @@ func minmax(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	} else {
 		iterable = args
 	}
-	iter := Iterate(iterable)
+	iter := IterateThread(thread, iterable)
 	if iter == nil {
 		return nil, fmt.Errorf("%s: %s value is not iterable", fn.Name(), iterable.Type())
 	}
 	defer iter.Done()
 	var extremum Value
 	if !iter.Next(&extremum) {
+		if err := IterErr(iter); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("%s: argument is an empty sequence", fn.Name())
 	}
 
@@ -765,13 +2446,16 @@ func minmax(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, err
 			key = res
 		}
 
-		if ok, err := Compare(op, key, extremeKey); err != nil {
+		if ok, err := thread.compare(op, key, extremeKey); err != nil {
 			return nil, err
 		} else if ok {
 			extremum = x
 			extremeKey = key
 		}
 	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
 	return extremum, nil
 }
 
@@ -792,39 +2476,130 @@ func ord(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		n := utf8.RuneCountInString(s)
 		return nil, fmt.Errorf("ord: string encodes %d Unicode code points, want 1", n)
 	}
+	if r == utf8.RuneError && sz == 1 {
+		return nil, fmt.Errorf("ord: byte 0x%02x is not valid UTF-8 (use byte_ord for its value)", s[0])
+	}
 	return MakeInt(int(r)), nil
 }
 
+// https://github.com/google/skylark/blob/master/doc/spec.md#parse_bool
+func parse_bool(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var s string
+	if err := UnpackPositionalArgs("parse_bool", args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(s) {
+	case "true", "1", "yes":
+		return True, nil
+	case "false", "0", "no":
+		return False, nil
+	}
+	return nil, fmt.Errorf("parse_bool: invalid literal %q, want true, false, yes, no, 1, or 0 (for the truth value of any string, use bool)", s)
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#predeclared
+func predeclared(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs("predeclared", args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	fr := thread.Caller()
+	if fr == nil {
+		return nil, fmt.Errorf("predeclared: not called from Skylark code")
+	}
+	fn, ok := fr.Callable().(*Function)
+	if !ok {
+		return nil, fmt.Errorf("predeclared: not called from Skylark code")
+	}
+	// Module-specific names take precedence over universal ones.
+	env := make(StringDict, len(Universe)+len(fn.predeclared))
+	for name, v := range Universe {
+		env[name] = v
+	}
+	for name, v := range fn.predeclared {
+		env[name] = v
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := new(Dict)
+	for _, name := range names {
+		result.SetKey(String(name), env[name]) // can't fail
+	}
+	// As with globals, freeze the snapshot but not the values,
+	// which belong to the application.
+	result.ht.frozen = true
+	return result, nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#print
 func print(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	// sep and end are recognized specially; other keyword
+	// arguments are printed after the positional ones.
+	sep, end := " ", "\n"
+	explicitEnd := false
+	others := kwargs[:0:0]
+	for _, pair := range kwargs {
+		k := string(pair[0].(String))
+		var ptr *string
+		switch k {
+		case "sep":
+			ptr = &sep
+		case "end":
+			ptr = &end
+		default:
+			others = append(others, pair)
+			continue
+		}
+		switch v := pair[1].(type) {
+		case String:
+			*ptr = string(v)
+			explicitEnd = explicitEnd || k == "end"
+		case NoneType:
+			// use the default
+		default:
+			return nil, fmt.Errorf("print: for parameter %s: got %s, want string or None", k, v.Type())
+		}
+	}
+
 	var buf bytes.Buffer
+	if thread.PrintWithPosition {
+		if caller := thread.Caller(); caller != nil {
+			posn := caller.Position()
+			fmt.Fprintf(&buf, "%s:%d: ", posn.Filename(), posn.Line)
+		}
+	}
 	path := make([]Value, 0, 4)
-	sep := ""
+	prefix := ""
 	for _, v := range args {
-		buf.WriteString(sep)
-		if s, ok := AsString(v); ok {
-			buf.WriteString(s)
-		} else {
-			writeValue(&buf, v, path)
-		}
-		sep = " "
+		buf.WriteString(prefix)
+		writeStr(&buf, v, path)
+		prefix = sep
 	}
-	for _, pair := range kwargs {
-		buf.WriteString(sep)
+	for _, pair := range others {
+		buf.WriteString(prefix)
 		buf.WriteString(string(pair[0].(String)))
 		buf.WriteString("=")
-		if s, ok := AsString(pair[1]); ok {
-			buf.WriteString(s)
-		} else {
-			writeValue(&buf, pair[1], path)
-		}
-		sep = " "
+		writeStr(&buf, pair[1], path)
+		prefix = sep
 	}
+	buf.WriteString(end)
 
 	if thread.Print != nil {
-		thread.Print(thread, buf.String())
+		// Thread.Print is responsible for line termination,
+		// unless the caller chose its own end.
+		msg := buf.String()
+		if !explicitEnd {
+			msg = strings.TrimSuffix(msg, end)
+		}
+		thread.Print(thread, msg)
+	} else if thread.Output != nil {
+		if _, err := thread.Output.Write(buf.Bytes()); err != nil {
+			return nil, fmt.Errorf("print: %v", err)
+		}
 	} else {
-		fmt.Fprintln(os.Stderr, &buf)
+		os.Stderr.Write(buf.Bytes())
 	}
 	return None, nil
 }
@@ -869,8 +2644,8 @@ func range_(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, err
 	return rangeValue{start: start, stop: stop, step: step, len: n}, nil
 }
 
-// A rangeValue is a comparable, immutable, indexable sequence of integers
-// defined by the three parameters to a range(...) call.
+// A rangeValue is a comparable, hashable, immutable, indexable sequence
+// of integers defined by the three parameters to a range(...) call.
 // Invariant: step != 0.
 type rangeValue struct{ start, stop, step, len int }
 
@@ -913,9 +2688,20 @@ func (r rangeValue) String() string {
 		return fmt.Sprintf("range(%d)", r.stop)
 	}
 }
-func (r rangeValue) Type() string          { return "range" }
-func (r rangeValue) Truth() Bool           { return r.len > 0 }
-func (r rangeValue) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: range") }
+func (r rangeValue) Type() string { return "range" }
+func (r rangeValue) Truth() Bool  { return r.len > 0 }
+func (r rangeValue) Hash() (uint32, error) {
+	// Hash only the parameters that determine the sequence,
+	// consistent with rangeEqual.
+	key := Tuple{MakeInt(r.len), None, None}
+	if r.len > 0 {
+		key[1] = MakeInt(r.start)
+	}
+	if r.len > 1 {
+		key[2] = MakeInt(r.step)
+	}
+	return key.Hash()
+}
 
 func (x rangeValue) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, error) {
 	y := y_.(rangeValue)
@@ -932,7 +2718,7 @@ func (x rangeValue) CompareSameType(op syntax.Token, y_ Value, depth int) (bool,
 func rangeEqual(x, y rangeValue) bool {
 	// Two ranges compare equal if they denote the same sequence.
 	return x.len == y.len &&
-		(x.len == 0 || x.start == y.start && x.step == y.step)
+		(x.len == 0 || x.start == y.start && (x.len == 1 || x.step == y.step))
 }
 
 func (r rangeValue) contains(x Int) bool {
@@ -962,32 +2748,89 @@ func (*rangeIterator) Done() {}
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#repr
 func repr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	var x Value
-	if err := UnpackPositionalArgs("repr", args, kwargs, 1, &x); err != nil {
+	var x, limit Value
+	if err := UnpackArgs("repr", args, kwargs, "x", &x, "limit?", &limit); err != nil {
 		return nil, err
 	}
+	if limit != nil && limit != None {
+		n, err := AsInt32(limit)
+		if err != nil {
+			return nil, fmt.Errorf("repr: for parameter \"limit\": %v", err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("repr: negative limit")
+		}
+		return String(ReprLimit(x, n)), nil
+	}
 	return String(x.String()), nil
 }
 
-// https://github.com/google/skylark/blob/master/doc/spec.md#reversed
-func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	var iterable Iterable
-	if err := UnpackPositionalArgs("reversed", args, kwargs, 1, &iterable); err != nil {
+// https://github.com/google/skylark/blob/master/doc/spec.md#require
+func require(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var cond, msg Value
+	if err := UnpackArgs("require", args, kwargs, "cond", &cond, "message", &msg); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
-	defer iter.Done()
-	var elems []Value
-	if n := Len(args[0]); n >= 0 {
-		elems = make([]Value, 0, n) // preallocate if length known
+	if cond.Truth() {
+		return None, nil
+	}
+
+	// A callable message is computed only on failure.
+	if fn, ok := msg.(Callable); ok {
+		v, err := Call(thread, fn, nil, nil)
+		if err != nil {
+			return nil, err // to preserve backtrace, don't modify error
+		}
+		msg = v
 	}
+	if s, ok := AsString(msg); ok {
+		return nil, fmt.Errorf("require: %s", s)
+	}
+	return nil, fmt.Errorf("require: %s", msg)
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#reversed
+func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var x Value
-	for iter.Next(&x) {
-		elems = append(elems, x)
+	if err := UnpackPositionalArgs("reversed", args, kwargs, 1, &x); err != nil {
+		return nil, err
 	}
-	n := len(elems)
-	for i := 0; i < n>>1; i++ {
-		elems[i], elems[n-1-i] = elems[n-1-i], elems[i]
+	var elems []Value
+	switch x := x.(type) {
+	case String:
+		// Yield the code points of the string, last first.
+		s := string(x)
+		n := utf8.RuneCountInString(s)
+		if err := thread.alloc(uint64(n)); err != nil {
+			return nil, err
+		}
+		elems = make([]Value, 0, n)
+		for len(s) > 0 {
+			_, size := utf8.DecodeLastRuneInString(s)
+			elems = append(elems, String(s[len(s)-size:]))
+			s = s[:len(s)-size]
+		}
+	case Indexable:
+		// opt: index backwards, without buffering the elements.
+		n := x.Len()
+		if err := thread.alloc(uint64(n)); err != nil {
+			return nil, err
+		}
+		elems = make([]Value, n)
+		for i := range elems {
+			elems[i] = x.Index(n - 1 - i)
+		}
+	case Iterable:
+		var err error
+		if elems, err = collect(thread, x); err != nil {
+			return nil, err
+		}
+		n := len(elems)
+		for i := 0; i < n>>1; i++ {
+			elems[i], elems[n-1-i] = elems[n-1-i], elems[i]
+		}
+	default:
+		return nil, fmt.Errorf("reversed: for parameter 1: got %s, want iterable or string", x.Type())
 	}
 	return NewList(elems), nil
 }
@@ -1000,14 +2843,20 @@ func set(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	}
 	set := new(Set)
 	if iterable != nil {
-		iter := iterable.Iterate()
+		iter := IterateThread(thread, iterable)
 		defer iter.Done()
 		var x Value
 		for iter.Next(&x) {
+			if err := thread.alloc(1); err != nil {
+				return nil, err
+			}
 			if err := set.Insert(x); err != nil {
 				return nil, err
 			}
 		}
+		if err := IterErr(iter); err != nil {
+			return nil, err
+		}
 	}
 	return set, nil
 }
@@ -1019,21 +2868,16 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	var reverse bool
 	if err := UnpackArgs("sorted", args, kwargs,
 		"iterable", &iterable,
+		"*", nil,
 		"key?", &key,
 		"reverse?", &reverse,
 	); err != nil {
 		return nil, err
 	}
 
-	iter := iterable.Iterate()
-	defer iter.Done()
-	var values []Value
-	if n := Len(iterable); n > 0 {
-		values = make(Tuple, 0, n) // preallocate if length is known
-	}
-	var x Value
-	for iter.Next(&x) {
-		values = append(values, x)
+	values, err := collect(thread, iterable)
+	if err != nil {
+		return nil, err
 	}
 
 	// Derive keys from values by applying key function.
@@ -1049,7 +2893,9 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 		}
 	}
 
-	slice := &sortSlice{keys: keys, values: values}
+	// Python's sort is stable, even when reversed, so we must use
+	// sort.Stable, not sort.Sort.
+	slice := &sortSlice{thread: thread, keys: keys, values: values}
 	if reverse {
 		sort.Stable(sort.Reverse(slice))
 	} else {
@@ -1059,6 +2905,7 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 }
 
 type sortSlice struct {
+	thread *Thread // options of the sorting thread, or nil
 	keys   []Value // nil => values[i] is key
 	values []Value
 	err    error
@@ -1070,7 +2917,7 @@ func (s *sortSlice) Less(i, j int) bool {
 	if s.keys == nil {
 		keys = s.values
 	}
-	ok, err := Compare(syntax.LT, keys[i], keys[j])
+	ok, err := s.thread.compare(syntax.LT, keys[i], keys[j])
 	if err != nil {
 		s.err = err
 	}
@@ -1080,55 +2927,278 @@ func (s *sortSlice) Swap(i, j int) {
 	if s.keys != nil {
 		s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
 	}
-	s.values[i], s.values[j] = s.values[j], s.values[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#stack_depth
+func stack_depth(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs("stack_depth", args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	depth := 0
+	for fr := thread.Caller(); fr != nil; fr = fr.parent {
+		depth++
+	}
+	return MakeInt(depth), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#str
+func str(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("str does not accept keyword arguments")
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("str: got %d arguments, want exactly 1", len(args))
+	}
+	switch x := args[0].(type) {
+	case String:
+		return x, nil
+	case HasStr:
+		return String(x.SkylarkStr()), nil
+	default:
+		return String(x.String()), nil
+	}
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#string_builder
+func string_builder(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs("string_builder", args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return new(StringBuilder), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#tuple
+func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var iterable Iterable
+	if err := UnpackPositionalArgs("tuple", args, kwargs, 0, &iterable); err != nil {
+		return nil, err
+	}
+	switch x := iterable.(type) {
+	case nil:
+		return Tuple(nil), nil
+	case Tuple:
+		return x, nil // immutable, so no need to copy
+	case *List:
+		// fast path: copy the backing array in one operation
+		if err := thread.alloc(uint64(len(x.elems))); err != nil {
+			return nil, err
+		}
+		return append(Tuple(nil), x.elems...), nil
+	}
+	elems, err := collect(thread, iterable)
+	if err != nil {
+		return nil, err
+	}
+	return Tuple(elems), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#type
+func type_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("type does not accept keyword arguments")
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("type: got %d arguments, want exactly 1", len(args))
+	}
+	return String(args[0].Type()), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#type_is
+func type_is(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	var name string
+	if err := UnpackPositionalArgs("type_is", args, kwargs, 2, &x, &name); err != nil {
+		return nil, err
+	}
+	return Bool(x.Type() == name), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#unescape
+func unescape(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var s string
+	if err := UnpackPositionalArgs("unescape", args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	u, err := syntax.Unescape(s)
+	if err != nil {
+		return nil, fmt.Errorf("unescape: %v", err)
+	}
+	return String(u), nil
 }
 
-// https://github.com/google/skylark/blob/master/doc/spec.md#str
-func str(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	if len(kwargs) > 0 {
-		return nil, fmt.Errorf("str does not accept keyword arguments")
+// https://github.com/google/skylark/blob/master/doc/spec.md#unflatten
+func unflatten(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var d *Dict
+	sep := "."
+	if err := UnpackArgs("unflatten", args, kwargs, "dict", &d, "sep?", &sep); err != nil {
+		return nil, err
 	}
-	if len(args) != 1 {
-		return nil, fmt.Errorf("str: got %d arguments, want exactly 1", len(args))
+	if sep == "" {
+		return nil, fmt.Errorf("unflatten: empty separator")
 	}
-	x := args[0]
-	if _, ok := AsString(x); !ok {
-		x = String(x.String())
+
+	// branches records the dicts created by unflatten, to distinguish
+	// them from leaf values that happen to be dicts.
+	branches := make(map[*Dict]bool)
+	result := new(Dict)
+	branches[result] = true
+	for _, item := range d.Items() {
+		key, ok := AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("unflatten: got %s key, want string", item[0].Type())
+		}
+		parts := strings.Split(key, sep)
+		node := result
+		for i, part := range parts[:len(parts)-1] {
+			v, found, _ := node.Get(String(part))
+			if !found {
+				child := new(Dict)
+				branches[child] = true
+				node.SetKey(String(part), child)
+				node = child
+				continue
+			}
+			child, ok := v.(*Dict)
+			if !ok || !branches[child] {
+				prefix := strings.Join(parts[:i+1], sep)
+				return nil, fmt.Errorf("unflatten: key %q is both a leaf and a prefix of key %q", prefix, key)
+			}
+			node = child
+		}
+		last := String(parts[len(parts)-1])
+		if v, found, _ := node.Get(last); found {
+			if child, ok := v.(*Dict); ok && branches[child] {
+				return nil, fmt.Errorf("unflatten: key %q is both a leaf and a prefix of another key", key)
+			}
+		}
+		node.SetKey(last, item[1])
 	}
-	return x, nil
+	return result, nil
 }
 
-// https://github.com/google/skylark/blob/master/doc/spec.md#tuple
-func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	var iterable Iterable
-	if err := UnpackPositionalArgs("tuple", args, kwargs, 0, &iterable); err != nil {
+// https://github.com/google/skylark/blob/master/doc/spec.md#vars
+func vars(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	var strict bool
+	if err := UnpackArgs("vars", args, kwargs, "x", &x, "strict?", &strict); err != nil {
 		return nil, err
 	}
-	if len(args) == 0 {
-		return Tuple(nil), nil
+
+	result := new(Dict)
+	hasMethods := false
+	if x, ok := x.(HasAttrs); ok {
+		for _, name := range x.AttrNames() {
+			v, err := x.Attr(name)
+			if err != nil {
+				return nil, fmt.Errorf("vars: %s.%s: %v", x.Type(), name, err)
+			}
+			if b, ok := v.(*Builtin); ok && b.Receiver() != nil {
+				hasMethods = true // a method, not a field
+				continue
+			}
+			if v != nil {
+				result.SetKey(String(name), v) // can't fail
+			}
+		}
+	} else {
+		hasMethods = true // (no fields at all)
 	}
-	iter := iterable.Iterate()
-	defer iter.Done()
-	var elems Tuple
-	if n := Len(iterable); n > 0 {
-		elems = make(Tuple, 0, n) // preallocate if length is known
+	if strict && result.Len() == 0 && hasMethods {
+		return nil, fmt.Errorf("vars: %s value has no fields", x.Type())
+	}
+	return result, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#weighted_index
+func weighted_index(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var weights Iterable
+	var seed Value
+	if err := UnpackPositionalArgs("weighted_index", args, kwargs, 2, &weights, &seed); err != nil {
+		return nil, err
 	}
+	var cumulative []uint64 // cumulative[i] is the sum of weights[:i+1]
+	var total uint64
+	iter := IterateThread(thread, weights)
+	defer iter.Done()
 	var x Value
 	for iter.Next(&x) {
-		elems = append(elems, x)
+		w, err := AsInt32(x)
+		if err != nil {
+			return nil, fmt.Errorf("weighted_index: weight %d: %v", len(cumulative), err)
+		}
+		if w < 0 {
+			return nil, fmt.Errorf("weighted_index: weight %d is negative (%d)", len(cumulative), w)
+		}
+		total += uint64(w)
+		cumulative = append(cumulative, total)
 	}
-	return elems, nil
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("weighted_index: weights have zero sum")
+	}
+	h, err := seed.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("weighted_index: seed: %v", err)
+	}
+	// Scale the mixed 32-bit hash to the range [0, total).
+	r, _ := bits.Mul64(uint64(mixHash(h))<<32, total)
+	i := sort.Search(len(cumulative), func(i int) bool { return r < cumulative[i] })
+	return MakeInt(i), nil
 }
 
-// https://github.com/google/skylark/blob/master/doc/spec.md#type
-func type_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
-	if len(kwargs) > 0 {
-		return nil, fmt.Errorf("type does not accept keyword arguments")
+// mixHash scrambles the bits of a hash so that similar seeds
+// (such as consecutive integers) yield unrelated results.
+// It is the finalizer of MurmurHash3.
+func mixHash(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#with_step_limit
+func with_step_limit(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var fn Callable
+	var n int
+	if err := UnpackArgs("with_step_limit", args, kwargs, "fn", &fn, "n", &n); err != nil {
+		return nil, err
 	}
-	if len(args) != 1 {
-		return nil, fmt.Errorf("type: got %d arguments, want exactly 1", len(args))
+	if n <= 0 {
+		return nil, fmt.Errorf("with_step_limit: got %d, want positive step limit", n)
 	}
-	return String(args[0].Type()), nil
+	return &stepLimited{fn: fn, n: uint64(n)}, nil
+}
+
+// A stepLimited is a function returned by with_step_limit.
+type stepLimited struct {
+	fn Callable
+	n  uint64
+}
+
+var _ Callable = (*stepLimited)(nil)
+
+func (l *stepLimited) Name() string          { return l.fn.Name() }
+func (l *stepLimited) String() string        { return fmt.Sprintf("<step-limited %s>", l.fn) }
+func (l *stepLimited) Type() string          { return "step_limited" }
+func (l *stepLimited) Freeze()               { l.fn.Freeze() }
+func (l *stepLimited) Truth() Bool           { return True }
+func (l *stepLimited) Hash() (uint32, error) { return l.fn.Hash() }
+
+func (l *stepLimited) CallInternal(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	// Tighten the thread's budget for the duration of the call,
+	// but never loosen it.
+	saved := thread.maxSteps
+	if limit := thread.steps + l.n; saved == 0 || limit < saved {
+		thread.maxSteps = limit
+	}
+	result, err := Call(thread, l.fn, args, kwargs)
+	thread.maxSteps = saved
+	return result, err
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#zip
@@ -1137,6 +3207,7 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		return nil, fmt.Errorf("zip does not accept keyword arguments")
 	}
 	rows, cols := 0, len(args)
+	hint := -1 // least estimated length, if rows is not known
 	iters := make([]Iterator, cols)
 	defer func() {
 		for _, iter := range iters {
@@ -1146,7 +3217,7 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		}
 	}()
 	for i, seq := range args {
-		it := Iterate(seq)
+		it := IterateThread(thread, seq)
 		if it == nil {
 			return nil, fmt.Errorf("zip: argument #%d is not iterable: %s", i+1, seq.Type())
 		}
@@ -1155,10 +3226,16 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		if i == 0 || n < rows {
 			rows = n // possibly -1
 		}
+		if h := lenHint(seq); h >= 0 && (hint < 0 || h < hint) {
+			hint = h
+		}
 	}
 	var result []Value
 	if rows >= 0 {
 		// length known
+		if err := thread.alloc(uint64(rows) * uint64(1+cols)); err != nil {
+			return nil, err // each row is a list element and a tuple
+		}
 		result = make([]Value, rows)
 		array := make(Tuple, cols*rows) // allocate a single backing array
 		for i := 0; i < rows; i++ {
@@ -1171,11 +3248,20 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		}
 	} else {
 		// length not known
+		if hint > 0 {
+			result = make([]Value, 0, hint) // preallocate if estimated
+		}
 	outer:
 		for {
+			if err := thread.alloc(uint64(1 + cols)); err != nil {
+				return nil, err
+			}
 			tuple := make(Tuple, cols)
 			for i, iter := range iters {
 				if !iter.Next(&tuple[i]) {
+					if err := IterErr(iter); err != nil {
+						return nil, err
+					}
 					break outer
 				}
 			}
@@ -1187,10 +3273,35 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
 // ---- methods of built-in types ---
 
+// https://github.com/google/skylark/blob/master/doc/spec.md#dict·fromkeys
+func dict_fromkeys(thread *Thread, fnname string, _ Value, args Tuple, kwargs []Tuple) (Value, error) {
+	var keys Iterable
+	var value Value = None
+	if err := UnpackArgs(fnname, args, kwargs, "keys", &keys, "value?", &value); err != nil {
+		return nil, err
+	}
+	dict := new(Dict)
+	iter := IterateThread(thread, keys)
+	defer iter.Done()
+	var k Value
+	for iter.Next(&k) {
+		if err := thread.alloc(1); err != nil {
+			return nil, err
+		}
+		if err := dict.Set(k, value); err != nil {
+			return nil, fmt.Errorf("%s: %v", fnname, err)
+		}
+	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
+	return dict, nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·get
-func dict_get(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_get(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var key, dflt Value
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &key, &dflt); err != nil {
+	if err := UnpackArgs(fnname, args, kwargs, "key", &key, "default?", &dflt); err != nil {
 		return nil, err
 	}
 	if v, ok, err := recv.(*Dict).Get(key); err != nil {
@@ -1204,7 +3315,7 @@ func dict_get(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, err
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·clear
-func dict_clear(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_clear(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1212,31 +3323,165 @@ func dict_clear(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, e
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·items
-func dict_items(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_items(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	if thread.dictViews {
+		return dictView{recv.(*Dict), viewItems}, nil
+	}
+	return dictView{recv.(*Dict), viewItems}.list(), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#dict·iteritems
+func dict_iteritems(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return dictView{recv.(*Dict), viewItems}, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#dict·iterkeys
+func dict_iterkeys(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return dictView{recv.(*Dict), viewKeys}, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#dict·itervalues
+func dict_itervalues(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	items := recv.(*Dict).Items()
-	res := make([]Value, len(items))
+	return dictView{recv.(*Dict), viewValues}, nil
+}
+
+// A dictView is a live view of the keys, values, or (key, value) pairs
+// of a dict, as returned by dict.iterkeys, dict.itervalues, and
+// dict.iteritems, and by dict.keys, dict.values, and dict.items in a
+// thread that enables views by SetDictViews.  Unlike a list, it does
+// not copy the entries, so iterating over it is cheap even for a large
+// dict.  The dict may not be modified while the view is being iterated:
+// as for any iteration over a dict, an attempt fails with an error such
+// as "cannot insert into hash table during iteration", not Python's
+// "dict changed size during iteration".
+type dictView struct {
+	dict *Dict
+	kind dictViewKind
+}
+
+type dictViewKind uint8
+
+const (
+	viewKeys dictViewKind = iota
+	viewValues
+	viewItems
+)
+
+var (
+	_ Sequence  = dictView{}
+	_ HasBinary = dictView{}
+)
+
+func (v dictView) Len() int    { return v.dict.Len() }
+func (v dictView) Freeze()     { v.dict.Freeze() }
+func (v dictView) Truth() Bool { return v.dict.Truth() }
+
+func (v dictView) Type() string {
+	switch v.kind {
+	case viewKeys:
+		return "dict_keys"
+	case viewValues:
+		return "dict_values"
+	}
+	return "dict_items"
+}
+
+func (v dictView) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", v.Type())
+}
+
+func (v dictView) Iterate() Iterator {
+	switch v.kind {
+	case viewKeys:
+		return v.dict.ht.iterate()
+	case viewValues:
+		return v.dict.ht.iterateValues()
+	}
+	return v.dict.ht.iterateItems()
+}
+
+func (v dictView) String() string { return v.Type() + "(" + v.list().String() + ")" }
+
+// list returns a new list of the elements of the view.
+func (v dictView) list() *List {
+	switch v.kind {
+	case viewKeys:
+		return NewList(v.dict.Keys())
+	}
+	items := v.dict.Items()
+	elems := make([]Value, len(items))
 	for i, item := range items {
-		res[i] = item // convert [2]Value to Value
+		if v.kind == viewValues {
+			elems[i] = item[1]
+		} else {
+			elems[i] = item // convert [2]Value to Value
+		}
+	}
+	return NewList(elems)
+}
+
+// Binary implements the 'in' operator, x in view.
+func (v dictView) Binary(op syntax.Token, x Value, side Side) (Value, error) {
+	if op != syntax.IN || side != Right {
+		return nil, nil
+	}
+	switch v.kind {
+	case viewKeys:
+		_, found, _ := v.dict.Get(x) // as for 'in dict', ignore errors
+		return Bool(found), nil
+	case viewValues:
+		iter := v.dict.ht.iterateValues()
+		defer iter.Done()
+		var y Value
+		for iter.Next(&y) {
+			if eq, err := Equal(y, x); err != nil {
+				return nil, err
+			} else if eq {
+				return True, nil
+			}
+		}
+		return False, nil
+	}
+	pair, ok := x.(Tuple)
+	if !ok || len(pair) != 2 {
+		return False, nil
+	}
+	y, found, _ := v.dict.Get(pair[0])
+	if !found {
+		return False, nil
 	}
-	return NewList(res), nil
+	eq, err := Equal(y, pair[1])
+	return Bool(eq), err
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·keys
-func dict_keys(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_keys(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
+	if thread.dictViews {
+		return dictView{recv.(*Dict), viewKeys}, nil
+	}
 	return NewList(recv.(*Dict).Keys()), nil
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·pop
-func dict_pop(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_pop(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*Dict)
 	var k, d Value
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &k, &d); err != nil {
+	if err := UnpackArgs(fnname, args, kwargs, "key", &k, "default?", &d); err != nil {
 		return nil, err
 	}
 	if v, found, err := recv.Delete(k); err != nil {
@@ -1246,11 +3491,11 @@ func dict_pop(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, er
 	} else if d != nil {
 		return d, nil
 	}
-	return nil, fmt.Errorf("pop: missing key")
+	return nil, fmt.Errorf("%s: key %v not in dict", fnname, k)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·popitem
-func dict_popitem(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_popitem(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1267,9 +3512,9 @@ func dict_popitem(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·setdefault
-func dict_setdefault(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_setdefault(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var key, dflt Value = nil, None
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &key, &dflt); err != nil {
+	if err := UnpackArgs(fnname, args, kwargs, "key", &key, "default?", &dflt); err != nil {
 		return nil, err
 	}
 	dict := recv.(*Dict)
@@ -1283,31 +3528,42 @@ func dict_setdefault(fnname string, recv Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·update
-func dict_update(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_update(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(args) > 1 {
 		return nil, fmt.Errorf("update: got %d arguments, want at most 1", len(args))
 	}
-	if err := updateDict(recv.(*Dict), args, kwargs); err != nil {
+	if err := updateDict(thread, recv.(*Dict), args, kwargs); err != nil {
 		return nil, fmt.Errorf("update: %v", err)
 	}
 	return None, nil
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#dict·update
-func dict_values(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func dict_values(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
-	items := recv.(*Dict).Items()
-	res := make([]Value, len(items))
-	for i, item := range items {
-		res[i] = item[1]
+	if thread.dictViews {
+		return dictView{recv.(*Dict), viewValues}, nil
+	}
+	return dictView{recv.(*Dict), viewValues}.list(), nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#enum·values
+func enum_values(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
 	}
-	return NewList(res), nil
+	e := recv.(*enumValue)
+	values := make([]Value, len(e.names))
+	for i, name := range e.names {
+		values[i] = e.fields[name]
+	}
+	return NewList(values), nil
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·append
-func list_append(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_append(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var object Value
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &object); err != nil {
@@ -1321,7 +3577,7 @@ func list_append(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·clear
-func list_clear(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_clear(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1329,7 +3585,7 @@ func list_clear(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·extend
-func list_extend(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_extend(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var iterable Iterable
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &iterable); err != nil {
@@ -1338,15 +3594,17 @@ func list_extend(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 	if err := recv.checkMutable("extend", true); err != nil {
 		return nil, err
 	}
-	listExtend(recv, iterable)
+	if err := listExtend(thread, recv, iterable); err != nil {
+		return nil, err
+	}
 	return None, nil
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·index
-func list_index(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_index(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
-	var value, start_, end_ Value
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &value, &start_, &end_); err != nil {
+	var value, start_, end_, dflt Value
+	if err := UnpackArgs(fnname, args, kwargs, "x", &value, "start?", &start_, "end?", &end_, "default?", &dflt); err != nil {
 		return nil, err
 	}
 
@@ -1362,11 +3620,14 @@ func list_index(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 			return MakeInt(i), nil
 		}
 	}
+	if dflt != nil {
+		return dflt, nil
+	}
 	return nil, fmt.Errorf("index: value not in list")
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·insert
-func list_insert(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_insert(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var index int
 	var object Value
@@ -1396,7 +3657,7 @@ func list_insert(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·remove
-func list_remove(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_remove(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := recv_.(*List)
 	var value Value
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &value); err != nil {
@@ -1417,7 +3678,7 @@ func list_remove(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#list·pop
-func list_pop(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func list_pop(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	list := recv.(*List)
 	index := list.Len() - 1
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &index); err != nil {
@@ -1435,7 +3696,7 @@ func list_pop(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, err
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·capitalize
-func string_capitalize(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_capitalize(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1447,7 +3708,7 @@ func string_capitalize(fnname string, recv Value, args Tuple, kwargs []Tuple) (V
 // - codepoints: successive substrings that encode a single Unicode code point.
 // - elem_ords: numeric values of successive bytes
 // - codepoint_ords: numeric values of successive Unicode code points
-func string_iterable(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_iterable(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1459,12 +3720,13 @@ func string_iterable(fnname string, recv Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·count
-func string_count(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_count(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 
 	var sub string
 	var start_, end_ Value
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &sub, &start_, &end_); err != nil {
+	var overlapping bool
+	if err := UnpackArgs(fnname, args, kwargs, "sub", &sub, "start?", &start_, "end?", &end_, "overlapping?", &overlapping); err != nil {
 		return nil, err
 	}
 
@@ -1477,11 +3739,24 @@ func string_count(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value
 	if start < end {
 		slice = recv[start:end]
 	}
-	return MakeInt(strings.Count(slice, sub)), nil
+	if !overlapping || sub == "" {
+		return MakeInt(strings.Count(slice, sub)), nil
+	}
+	// Each match after the first may begin within the previous one.
+	n := 0
+	for {
+		i := strings.Index(slice, sub)
+		if i < 0 {
+			break
+		}
+		n++
+		slice = slice[i+1:]
+	}
+	return MakeInt(n), nil
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·isalnum
-func string_isalnum(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isalnum(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1495,7 +3770,7 @@ func string_isalnum(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·isalpha
-func string_isalpha(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isalpha(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1509,7 +3784,7 @@ func string_isalpha(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·isdigit
-func string_isdigit(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isdigit(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1523,7 +3798,7 @@ func string_isdigit(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·islower
-func string_islower(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_islower(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1542,7 +3817,7 @@ func isCasedString(s string) bool {
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·isspace
-func string_isspace(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isspace(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1556,7 +3831,7 @@ func string_isspace(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·istitle
-func string_istitle(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_istitle(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1587,7 +3862,7 @@ func string_istitle(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·isupper
-func string_isupper(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_isupper(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1596,18 +3871,21 @@ func string_isupper(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·find
-func string_find(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_find(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(fnname, string(recv.(String)), args, kwargs, true, false)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·format
-func string_format(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_format(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	format := string(recv_.(String))
 	var auto, manual bool // kinds of positional indexing used
 	path := make([]Value, 0, 4)
 	var buf bytes.Buffer
 	index := 0
 	for {
+		if err := checkFormatSize(thread, &buf); err != nil {
+			return nil, err
+		}
 		literal := format
 		i := strings.IndexByte(format, '{')
 		if i >= 0 {
@@ -1674,6 +3952,18 @@ func string_format(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Valu
 			}
 		}
 
+		if strings.Contains(name, "{") {
+			return nil, fmt.Errorf("nested replacement fields not supported")
+		}
+
+		// Split "base.attr[key]..." into the argument name
+		// and the chain of accessors that follows it.
+		fieldname := name
+		var accessors string
+		if i := strings.IndexAny(name, ".["); i >= 0 {
+			name, accessors = name[:i], name[i:]
+		}
+
 		if name == "" {
 			// "{}": automatic indexing
 			if manual {
@@ -1705,21 +3995,18 @@ func string_format(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Valu
 				}
 			}
 			if arg == nil {
-				// Skylark does not support Python's x.y or a[i] syntaxes,
-				// or nested use of {...}.
-				if strings.Contains(name, ".") {
-					return nil, fmt.Errorf("attribute syntax x.y is not supported in replacement fields: %s", name)
-				}
-				if strings.Contains(name, "[") {
-					return nil, fmt.Errorf("element syntax a[i] is not supported in replacement fields: %s", name)
-				}
-				if strings.Contains(name, "{") {
-					return nil, fmt.Errorf("nested replacement fields not supported")
-				}
 				return nil, fmt.Errorf("keyword %s not found", name)
 			}
 		}
 
+		if accessors != "" {
+			var err error
+			arg, err = formatAccess(arg, fieldname, accessors)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		if spec != "" {
 			// Skylark does not support Python's format_spec features.
 			return nil, fmt.Errorf("format spec features not supported in replacement fields: %s", spec)
@@ -1727,51 +4014,112 @@ func string_format(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Valu
 
 		switch conv {
 		case "s":
-			if str, ok := AsString(arg); ok {
-				buf.WriteString(str)
-			} else {
-				writeValue(&buf, arg, path)
-			}
+			writeStr(&buf, arg, path)
 		case "r":
 			writeValue(&buf, arg, path)
 		default:
 			return nil, fmt.Errorf("unknown conversion %q", conv)
 		}
 	}
+	if err := checkFormatSize(thread, &buf); err != nil {
+		return nil, err
+	}
 	return String(buf.String()), nil
 }
 
+// formatAccess applies the chain of attribute (.name) and element
+// ([key]) accessors of a str.format replacement field to the argument x.
+// As in Python, an element key consisting only of decimal digits is an
+// int; any other key is a string.
+func formatAccess(x Value, field, accessors string) (Value, error) {
+	for accessors != "" {
+		switch accessors[0] {
+		case '.':
+			accessors = accessors[1:]
+			i := strings.IndexAny(accessors, ".[")
+			if i < 0 {
+				i = len(accessors)
+			}
+			name := accessors[:i]
+			accessors = accessors[i:]
+			if name == "" {
+				return nil, fmt.Errorf("empty attribute in replacement field: %s", field)
+			}
+			v, err := getAttr(nil, x, name)
+			if err != nil {
+				return nil, err
+			}
+			x = v
+
+		case '[':
+			i := strings.IndexByte(accessors, ']')
+			if i < 0 {
+				return nil, fmt.Errorf("missing ']' in replacement field: %s", field)
+			}
+			key := accessors[1:i]
+			accessors = accessors[i+1:]
+			if key == "" {
+				return nil, fmt.Errorf("empty element index in replacement field: %s", field)
+			}
+			var k Value = String(key)
+			if strings.Trim(key, "0123456789") == "" {
+				if n, err := strconv.Atoi(key); err == nil {
+					k = MakeInt(n)
+				}
+			}
+			v, err := getIndex(nil, x, k)
+			if err != nil {
+				return nil, err
+			}
+			x = v
+
+		default:
+			return nil, fmt.Errorf("only '.' or '[' may follow ']' in replacement field: %s", field)
+		}
+	}
+	return x, nil
+}
+
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·index
-func string_index(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_index(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(fnname, string(recv.(String)), args, kwargs, false, false)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·join
-func string_join(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_join(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var iterable Iterable
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &iterable); err != nil {
+	coerce := false
+	if err := UnpackArgs(fnname, args, kwargs, "iterable", &iterable, "coerce?", &coerce); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
+	iter := IterateThread(thread, iterable)
 	defer iter.Done()
 	var buf bytes.Buffer
+	var path []Value
 	var x Value
 	for i := 0; iter.Next(&x); i++ {
 		if i > 0 {
 			buf.WriteString(recv)
 		}
+		if coerce {
+			writeStr(&buf, x, path)
+			continue
+		}
 		s, ok := AsString(x)
 		if !ok {
 			return nil, fmt.Errorf("in list, want string, got %s", x.Type())
 		}
 		buf.WriteString(s)
 	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
 	return String(buf.String()), nil
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·lower
-func string_lower(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_lower(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1779,7 +4127,7 @@ func string_lower(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·lstrip
-func string_lstrip(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_lstrip(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1787,7 +4135,7 @@ func string_lstrip(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·partition
-func string_partition(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_partition(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var sep string
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &sep); err != nil {
@@ -1816,7 +4164,7 @@ func string_partition(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (V
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·replace
-func string_replace(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_replace(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var old, new string
 	count := -1
@@ -1827,17 +4175,17 @@ func string_replace(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Val
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·rfind
-func string_rfind(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_rfind(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(fnname, string(recv.(String)), args, kwargs, true, true)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·rindex
-func string_rindex(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_rindex(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	return string_find_impl(fnname, string(recv.(String)), args, kwargs, false, true)
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·rstrip
-func string_rstrip(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_rstrip(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1846,7 +4194,7 @@ func string_rstrip(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·startswith
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·endswith
-func string_startswith(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_startswith(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var x Value
 	var start, end Value = None, None
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &x, &start, &end); err != nil {
@@ -1891,7 +4239,7 @@ func string_startswith(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·strip
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·lstrip
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·rstrip
-func string_strip(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_strip(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var chars string
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &chars); err != nil {
 		return nil, err
@@ -1922,7 +4270,7 @@ func string_strip(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·title
-func string_title(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_title(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1930,7 +4278,7 @@ func string_title(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value,
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·upper
-func string_upper(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_upper(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
 		return nil, err
 	}
@@ -1939,7 +4287,7 @@ func string_upper(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value,
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·split
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·rsplit
-func string_split(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_split(thread *Thread, fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
 	recv := string(recv_.(String))
 	var sep_ Value
 	maxsplit := -1
@@ -2042,7 +4390,7 @@ func splitspace(s string, max int) []string {
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#string·splitlines
-func string_splitlines(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func string_splitlines(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var keepends bool
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &keepends); err != nil {
 		return nil, err
@@ -2066,20 +4414,142 @@ func string_splitlines(fnname string, recv Value, args Tuple, kwargs []Tuple) (V
 }
 
 // https://github.com/google/skylark/blob/master/doc/spec.md#set·union.
-func set_union(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+func set_union(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
 	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &iterable); err != nil {
 		return nil, err
 	}
-	iter := iterable.Iterate()
-	defer iter.Done()
-	union, err := recv.(*Set).Union(iter)
+	var union Value
+	var err error
+	if y, ok := iterable.(*Set); ok {
+		union, err = setUnion(recv.(*Set), y)
+	} else {
+		iter := IterateThread(thread, iterable)
+		defer iter.Done()
+		union, err = recv.(*Set).Union(iter)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("union: %v", err)
 	}
 	return union, nil
 }
 
+// https://github.com/google/skylark/blob/master/doc/spec.md#set·update.
+func set_update(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	return setUpdate(thread, fnname, recv, args, kwargs, func(s *Set, elems []Value) error {
+		for _, x := range elems {
+			if err := s.Insert(x); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#set·intersection_update.
+func set_intersection_update(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	return setUpdate(thread, fnname, recv, args, kwargs, func(s *Set, elems []Value) error {
+		other := new(Set)
+		for _, x := range elems {
+			if err := other.Insert(x); err != nil {
+				return err
+			}
+		}
+		for _, x := range s.elems() {
+			if found, _ := other.Has(x); !found {
+				s.Delete(x) // cannot fail
+			}
+		}
+		return nil
+	})
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#set·difference_update.
+func set_difference_update(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	return setUpdate(thread, fnname, recv, args, kwargs, func(s *Set, elems []Value) error {
+		for _, x := range elems {
+			if _, err := s.Delete(x); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#set·symmetric_difference_update.
+func set_symmetric_difference_update(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	return setUpdate(thread, fnname, recv, args, kwargs, func(s *Set, elems []Value) error {
+		seen := new(Set)
+		for _, x := range elems {
+			if found, err := seen.Has(x); err != nil {
+				return err
+			} else if found {
+				continue // an element appearing twice is toggled only once
+			}
+			seen.Insert(x)
+			if found, _ := s.Has(x); found {
+				s.Delete(x)
+			} else {
+				s.Insert(x)
+			}
+		}
+		return nil
+	})
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#string_builder·append
+func string_builder_append(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	var s string
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	if err := recv.(*StringBuilder).WriteString(s); err != nil {
+		return nil, err
+	}
+	return None, nil
+}
+
+// https://github.com/google/skylark/blob/master/doc/spec.md#string_builder·build
+func string_builder_build(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return recv.(*StringBuilder).Build(), nil
+}
+
+// setUpdate is the common implementation of the in-place set
+// operations.  It applies update to the receiver and the elements
+// of the iterable argument, which are gathered before any
+// mutation so that the argument may be the receiver itself.
+func setUpdate(thread *Thread, fnname string, recv Value, args Tuple, kwargs []Tuple, update func(*Set, []Value) error) (Value, error) {
+	var iterable Iterable
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &iterable); err != nil {
+		return nil, err
+	}
+	s := recv.(*Set)
+	if err := s.ht.checkMutable("update"); err != nil {
+		return nil, fmt.Errorf("%s: %v", fnname, err)
+	}
+	var elems []Value
+	iter := IterateThread(thread, iterable)
+	var x Value
+	for iter.Next(&x) {
+		if err := thread.alloc(1); err != nil {
+			iter.Done()
+			return nil, err
+		}
+		elems = append(elems, x)
+	}
+	iter.Done()
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
+	if err := update(s, elems); err != nil {
+		return nil, fmt.Errorf("%s: %v", fnname, err)
+	}
+	return None, nil
+}
+
 // Common implementation of string_{r}{find,index}.
 func string_find_impl(fnname string, s string, args Tuple, kwargs []Tuple, allowError, last bool) (Value, error) {
 	var sub string
@@ -2114,7 +4584,7 @@ func string_find_impl(fnname string, s string, args Tuple, kwargs []Tuple, allow
 
 // Common implementation of builtin dict function and dict.update method.
 // Precondition: len(updates) == 0 or 1.
-func updateDict(dict *Dict, updates Tuple, kwargs []Tuple) error {
+func updateDict(thread *Thread, dict *Dict, updates Tuple, kwargs []Tuple) error {
 	if len(updates) == 1 {
 		switch updates := updates[0].(type) {
 		case NoneType:
@@ -2128,14 +4598,17 @@ func updateDict(dict *Dict, updates Tuple, kwargs []Tuple) error {
 			}
 		default:
 			// all other sequences
-			iter := Iterate(updates)
+			iter := IterateThread(thread, updates)
 			if iter == nil {
 				return fmt.Errorf("got %s, want iterable", updates.Type())
 			}
 			defer iter.Done()
 			var pair Value
 			for i := 0; iter.Next(&pair); i++ {
-				iter2 := Iterate(pair)
+				if err := thread.alloc(1); err != nil {
+					return err
+				}
+				iter2 := IterateThread(thread, pair)
 				if iter2 == nil {
 					return fmt.Errorf("dictionary update sequence element #%d is not iterable (%s)", i, pair.Type())
 
@@ -2154,6 +4627,9 @@ func updateDict(dict *Dict, updates Tuple, kwargs []Tuple) error {
 					return err
 				}
 			}
+			if err := IterErr(iter); err != nil {
+				return err
+			}
 		}
 	}
 
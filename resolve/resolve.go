@@ -95,6 +95,7 @@ var (
 	AllowSet            = false // allow the 'set' built-in
 	AllowGlobalReassign = false // allow reassignment to globals declared in same file (deprecated)
 	AllowBitwise        = false // allow bitwise operations (&, |, ^, ~, <<, and >>)
+	AllowPositionalOnly = false // allow positional-only parameters (def f(x, /))
 )
 
 // File resolves the specified file.
@@ -687,7 +688,8 @@ func (r *resolver) function(pos syntax.Position, name string, function *syntax.F
 	r.push(b)
 
 	const allowRebind = false
-	var seenVarargs, seenKwargs, seenOptional bool
+	var seenVarargs, seenKwargs, seenOptional, seenSlash bool
+	nparams := 0 // number of ordinary parameters so far
 	for _, param := range function.Params {
 		switch param := param.(type) {
 		case *syntax.Ident:
@@ -702,6 +704,7 @@ func (r *resolver) function(pos syntax.Position, name string, function *syntax.F
 			if r.bind(param, allowRebind) {
 				r.errorf(pos, "duplicate parameter: %s", param.Name)
 			}
+			nparams++
 
 		case *syntax.BinaryExpr:
 			// e.g. y=dflt
@@ -714,9 +717,24 @@ func (r *resolver) function(pos syntax.Position, name string, function *syntax.F
 				r.errorf(pos, "duplicate parameter: %s", id.Name)
 			}
 			seenOptional = true
+			nparams++
 
 		case *syntax.UnaryExpr:
-			// *args or **kwargs
+			// *args or **kwargs or /
+			if param.Op == syntax.SLASH {
+				if !AllowPositionalOnly {
+					r.errorf(param.OpPos, doesnt+"support positional-only parameters")
+				} else if seenSlash {
+					r.errorf(param.OpPos, "multiple / not allowed")
+				} else if seenVarargs || seenKwargs {
+					r.errorf(param.OpPos, "/ may not follow *args or **kwargs")
+				} else if nparams == 0 {
+					r.errorf(param.OpPos, "/ must follow at least one parameter")
+				}
+				seenSlash = true
+				function.NumPositionalOnly = nparams
+				continue
+			}
 			if param.Op == syntax.STAR {
 				if seenKwargs {
 					r.errorf(pos, "*args may not follow **kwargs")
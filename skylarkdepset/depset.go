@@ -0,0 +1,298 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package skylarkdepset defines the Skylark 'depset' type,
+// an optional language extension.
+//
+// A depset is an immutable collection of elements formed from a list
+// of direct elements and a list of transitive depsets, in the style of
+// Bazel.  A depset holds references to its transitive depsets, so
+// constructing a depset takes time proportional to the number of its
+// direct elements and transitive depsets, not to the total number of
+// elements they contain: merging N depsets is O(N), regardless of
+// their size.  The elements are enumerated, without duplicates, only
+// when the depset is flattened by to_list or by iteration.
+package skylarkdepset
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/google/skylark"
+)
+
+// Make is the implementation of a built-in function that creates a
+// depset from a list of direct elements and a list of transitive
+// depsets.
+//
+// An application can add 'depset' to the Skylark environment like so:
+//
+//	globals := skylark.StringDict{
+//		"depset":  skylark.NewBuiltin("depset", skylarkdepset.Make),
+//	}
+func Make(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var direct, transitive skylark.Iterable
+	order := "default"
+	if err := skylark.UnpackArgs("depset", args, kwargs,
+		"direct?", &direct, "order?", &order, "transitive?", &transitive); err != nil {
+		return nil, err
+	}
+	ord, ok := orders[order]
+	if !ok {
+		return nil, fmt.Errorf("depset: invalid order %q", order)
+	}
+
+	d := &Depset{order: ord}
+	if direct != nil {
+		iter := skylark.IterateThread(thread, direct)
+		defer iter.Done()
+		var x skylark.Value
+		for iter.Next(&x) {
+			if _, err := x.Hash(); err != nil {
+				return nil, fmt.Errorf("depset: element %s is not hashable: %v", x, err)
+			}
+			d.direct = append(d.direct, x)
+		}
+		if err := skylark.IterErr(iter); err != nil {
+			return nil, err
+		}
+	}
+	if transitive != nil {
+		iter := skylark.IterateThread(thread, transitive)
+		defer iter.Done()
+		var x skylark.Value
+		for iter.Next(&x) {
+			t, ok := x.(*Depset)
+			if !ok {
+				return nil, fmt.Errorf("depset: for parameter transitive: got %s element, want depset", x.Type())
+			}
+			if t.empty {
+				continue // discard
+			}
+			if t.order != ord && t.order != defaultOrder && ord != defaultOrder {
+				return nil, fmt.Errorf("depset: order %q is incompatible with transitive depset of order %q", ord, t.order)
+			}
+			d.transitive = append(d.transitive, t)
+		}
+		if err := skylark.IterErr(iter); err != nil {
+			return nil, err
+		}
+	}
+	d.empty = len(d.direct) == 0 && len(d.transitive) == 0
+	return d, nil
+}
+
+// An order is a traversal order of a depset.
+type order string
+
+const (
+	defaultOrder order = "default"
+	postorder    order = "postorder"
+	preorder     order = "preorder"
+	topological  order = "topological"
+)
+
+var orders = map[string]order{
+	"default":     defaultOrder,
+	"postorder":   postorder,
+	"preorder":    preorder,
+	"topological": topological,
+}
+
+// A Depset is an immutable Skylark value that represents a set of
+// elements formed from a list of direct elements and a list of
+// transitive depsets, in a traversal order that determines the order
+// of the elements when flattened.
+//
+// In postorder (and the default order), the elements of the transitive
+// depsets, from left to right, precede the direct elements.
+// In preorder, the direct elements precede the elements of the
+// transitive depsets.  In both cases, only the first occurrence of
+// each element is retained.
+// In topological order, the direct elements of each depset precede the
+// elements of all the depsets it transitively includes, so that, as in
+// a linker command line, an element precedes the elements on which it
+// depends.
+//
+// The to_list method flattens a depset in its own order, or in the
+// order specified by its optional order parameter.
+type Depset struct {
+	order      order
+	direct     []skylark.Value
+	transitive []*Depset // non-empty depsets only
+	empty      bool
+}
+
+var (
+	_ skylark.Iterable = (*Depset)(nil)
+	_ skylark.HasAttrs = (*Depset)(nil)
+)
+
+// Iterate returns an iterator over the elements of the depset in its
+// traversal order.  The depset is flattened only when iteration begins.
+func (d *Depset) Iterate() skylark.Iterator {
+	elems, _ := d.ToList() // can't fail: elements are hashable
+	return &iterator{elems: elems}
+}
+
+type iterator struct {
+	elems []skylark.Value
+}
+
+func (it *iterator) Next(p *skylark.Value) bool {
+	if len(it.elems) == 0 {
+		return false
+	}
+	*p = it.elems[0]
+	it.elems = it.elems[1:]
+	return true
+}
+
+func (it *iterator) Done() {}
+
+func (d *Depset) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("depset(")
+	elems, _ := d.ToList()
+	buf.WriteString(skylark.NewList(elems).String())
+	if d.order != defaultOrder {
+		fmt.Fprintf(&buf, ", order = %q", string(d.order))
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+func (d *Depset) Type() string        { return "depset" }
+func (d *Depset) Freeze()             {} // immutable; elements are hashable
+func (d *Depset) Truth() skylark.Bool { return !skylark.Bool(d.empty) }
+
+func (d *Depset) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: depset")
+}
+
+func (d *Depset) Attr(name string) (skylark.Value, error) {
+	if m := methods[name]; m != nil {
+		return m.BindReceiver(d), nil
+	}
+	return nil, nil
+}
+
+func (d *Depset) AttrNames() []string {
+	names := make([]string, 0, len(methods))
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var methods = map[string]*skylark.Builtin{
+	"to_list": skylark.NewBuiltin("to_list", depset_to_list),
+}
+
+func depset_to_list(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	d := fn.Receiver().(*Depset)
+	ord := string(d.order)
+	if err := skylark.UnpackArgs("to_list", args, kwargs, "order?", &ord); err != nil {
+		return nil, err
+	}
+	if _, ok := orders[ord]; !ok {
+		return nil, fmt.Errorf("to_list: invalid order %q", ord)
+	}
+	elems, err := d.toList(order(ord))
+	if err != nil {
+		return nil, err
+	}
+	return skylark.NewList(elems), nil
+}
+
+// ToList returns the elements of the depset, without duplicates,
+// in the depset's traversal order.
+func (d *Depset) ToList() ([]skylark.Value, error) { return d.toList(d.order) }
+
+// toList returns the elements of the depset, without duplicates,
+// in the specified traversal order.
+func (d *Depset) toList(ord order) ([]skylark.Value, error) {
+	f := flattener{
+		seen:    new(skylark.Set),
+		visited: make(map[*Depset]bool),
+	}
+	if ord == topological {
+		if err := f.walkTopological(d); err != nil {
+			return nil, err
+		}
+		// Reverse the reversed postorder.
+		for i, j := 0, len(f.elems)-1; i < j; i, j = i+1, j-1 {
+			f.elems[i], f.elems[j] = f.elems[j], f.elems[i]
+		}
+		return f.elems, nil
+	}
+	if err := f.walk(d, ord); err != nil {
+		return nil, err
+	}
+	return f.elems, nil
+}
+
+// A flattener accumulates the distinct elements of a depset.
+type flattener struct {
+	seen    *skylark.Set     // elements already emitted
+	visited map[*Depset]bool // depsets already traversed
+	elems   []skylark.Value
+}
+
+func (f *flattener) walk(d *Depset, ord order) error {
+	if f.visited[d] {
+		return nil // already traversed by another path
+	}
+	f.visited[d] = true
+	if ord == preorder {
+		if err := f.emit(d.direct); err != nil {
+			return err
+		}
+	}
+	for _, t := range d.transitive {
+		if err := f.walk(t, ord); err != nil {
+			return err
+		}
+	}
+	if ord != preorder {
+		if err := f.emit(d.direct); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTopological emits the elements of d in reverse topological order,
+// visiting transitive depsets and direct elements from right to left.
+func (f *flattener) walkTopological(d *Depset) error {
+	if f.visited[d] {
+		return nil
+	}
+	f.visited[d] = true
+	for i := len(d.transitive) - 1; i >= 0; i-- {
+		if err := f.walkTopological(d.transitive[i]); err != nil {
+			return err
+		}
+	}
+	for i := len(d.direct) - 1; i >= 0; i-- {
+		if err := f.emit(d.direct[i : i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *flattener) emit(elems []skylark.Value) error {
+	for _, x := range elems {
+		if found, err := f.seen.Has(x); err != nil {
+			return err
+		} else if !found {
+			f.seen.Insert(x)
+			f.elems = append(f.elems, x)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarkdepset_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/resolve"
+	"github.com/google/skylark/skylarkdepset"
+	"github.com/google/skylark/skylarktest"
+)
+
+func init() {
+	// The tests make extensive use of these not-yet-standard features.
+	resolve.AllowLambda = true
+	resolve.AllowNestedDef = true
+}
+
+func Test(t *testing.T) {
+	testdata := skylarktest.DataFile("skylark/skylarkdepset", ".")
+	thread := &skylark.Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	filename := filepath.Join(testdata, "testdata/depset.sky")
+	predeclared := skylark.StringDict{
+		"depset": skylark.NewBuiltin("depset", skylarkdepset.Make),
+	}
+	if _, err := skylark.ExecFile(thread, filename, nil, predeclared); err != nil {
+		if err, ok := err.(*skylark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *skylark.Thread, module string) (skylark.StringDict, error) {
+	if module == "assert.sky" {
+		return skylarktest.LoadAssertModule()
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
+
+// chain returns a chain of n depsets, each of which adds one direct
+// element, drawn cyclically from m distinct values, to its predecessor.
+func chain(tb testing.TB, n, m int) skylark.Value {
+	thread := new(skylark.Thread)
+	depset := skylark.NewBuiltin("depset", skylarkdepset.Make)
+	d, err := skylark.Call(thread, depset, nil, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		d, err = skylark.Call(thread, depset, nil, []skylark.Tuple{
+			{skylark.String("direct"), skylark.Tuple{skylark.MakeInt(i % m)}},
+			{skylark.String("transitive"), skylark.Tuple{d}},
+		})
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return d
+}
+
+func TestChain(t *testing.T) {
+	d := chain(t, 10000, 100)
+	elems, err := d.(*skylarkdepset.Depset).ToList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elems) != 100 {
+		t.Errorf("len(to_list()) = %d, want 100", len(elems))
+	}
+}
+
+// BenchmarkMerge measures the cost of merging depsets,
+// which should not depend on the number of their elements.
+func BenchmarkMerge(b *testing.B) {
+	for _, size := range []int{10, 10000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			d := chain(b, size, size)
+			thread := new(skylark.Thread)
+			depset := skylark.NewBuiltin("depset", skylarkdepset.Make)
+			kwargs := []skylark.Tuple{{skylark.String("transitive"), skylark.Tuple{d, d, d}}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := skylark.Call(thread, depset, nil, kwargs); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package skylarkre defines the Skylark 're' module of regular
+// expression operations, an optional language extension.
+//
+// The module is modeled on Python's re module, but patterns use the
+// RE2 syntax of Go's regexp package, which does not support
+// backreferences or lookaround assertions, and replacement templates
+// use Go's $1 and ${name} notation in place of Python's \1 and
+// \g<name>.  See https://github.com/google/re2/wiki/Syntax.
+//
+// re.compile(pattern) returns a value of type regexp, which has
+// methods match, search, findall, split, and sub.  The module provides
+// functions of the same names that accept a pattern, either a string
+// or a regexp, as their first argument.  A regexp is immutable and
+// hashable, and two regexps are equal if their patterns are equal.
+//
+// The match and search operations return None or a value of type
+// match, whose groups method returns a tuple of the subgroups of the
+// match, and whose groupdict method returns a dict of its named
+// subgroups.
+package skylarkre
+
+import (
+	"fmt"
+	"regexp"
+	resyntax "regexp/syntax"
+	"sort"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/syntax"
+)
+
+// Module is the 're' module.
+//
+// An application can add 're' to the Skylark environment like so:
+//
+//	globals := skylark.StringDict{
+//		"re":  skylarkre.Module,
+//	}
+var Module skylark.Value = &module{
+	name: "re",
+	members: skylark.StringDict{
+		"compile": skylark.NewBuiltin("compile", compile).WithSignature("pattern"),
+		"findall": function("findall"),
+		"match":   function("match"),
+		"search":  function("search"),
+		"split":   function("split"),
+		"sub":     function("sub"),
+	},
+}
+
+func compile(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var pattern string
+	if err := skylark.UnpackArgs("compile", args, kwargs, "pattern", &pattern); err != nil {
+		return nil, err
+	}
+	re, err := Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("compile: %v", err)
+	}
+	return re, nil
+}
+
+// function returns the module-level function of the specified name,
+// which calls the regexp method of the same name on its first
+// argument, a pattern.
+func function(name string) *skylark.Builtin {
+	method := methods[name]
+	return skylark.NewBuiltin(name, func(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s: missing argument for pattern", name)
+		}
+		var re *Regexp
+		switch pattern := args[0].(type) {
+		case *Regexp:
+			re = pattern
+		case skylark.String:
+			var err error
+			re, err = Compile(string(pattern))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: got %s pattern, want string or regexp", name, pattern.Type())
+		}
+		return skylark.Call(thread, method.BindReceiver(re), args[1:], kwargs)
+	})
+}
+
+// A module is a named collection of built-in values.
+type module struct {
+	name    string
+	members skylark.StringDict
+}
+
+var _ skylark.HasAttrs = (*module)(nil)
+
+func (m *module) String() string        { return fmt.Sprintf("<module %s>", m.name) }
+func (m *module) Type() string          { return "module" }
+func (m *module) Freeze()               {} // immutable
+func (m *module) Truth() skylark.Bool   { return skylark.True }
+func (m *module) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", m.Type()) }
+
+func (m *module) Attr(name string) (skylark.Value, error) { return m.members[name], nil }
+
+func (m *module) AttrNames() []string {
+	names := make([]string, 0, len(m.members))
+	for name := range m.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A Regexp is an immutable Skylark value representing a compiled
+// regular expression.
+type Regexp struct {
+	re       *regexp.Regexp
+	anchored *regexp.Regexp // re, anchored at the start of the text
+}
+
+// Compile parses a regular expression in RE2 syntax and returns,
+// if successful, a Regexp value.
+func Compile(pattern string) (*Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	// Anchor the parsed pattern, not its text: a textual wrapper
+	// may be misparsed, for example after a trailing \Q.
+	tree, err := resyntax.Parse(pattern, resyntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	tree = &resyntax.Regexp{
+		Op:  resyntax.OpConcat,
+		Sub: []*resyntax.Regexp{{Op: resyntax.OpBeginText}, tree},
+	}
+	anchored, err := regexp.Compile(tree.String())
+	if err != nil {
+		return nil, err
+	}
+	return &Regexp{re: re, anchored: anchored}, nil
+}
+
+var (
+	_ skylark.Comparable = (*Regexp)(nil)
+	_ skylark.HasAttrs   = (*Regexp)(nil)
+)
+
+func (r *Regexp) String() string {
+	return fmt.Sprintf("re.compile(%s)", skylark.String(r.re.String()))
+}
+func (r *Regexp) Type() string          { return "regexp" }
+func (r *Regexp) Freeze()               {} // immutable
+func (r *Regexp) Shareable()            {}
+func (r *Regexp) Truth() skylark.Bool   { return skylark.True }
+func (r *Regexp) Hash() (uint32, error) { return skylark.String(r.re.String()).Hash() }
+
+// Pattern returns the source text of the regular expression.
+func (r *Regexp) Pattern() string { return r.re.String() }
+
+func (x *Regexp) CompareSameType(op syntax.Token, y_ skylark.Value, depth int) (bool, error) {
+	y := y_.(*Regexp)
+	switch op {
+	case syntax.EQL:
+		return x.re.String() == y.re.String(), nil
+	case syntax.NEQ:
+		return x.re.String() != y.re.String(), nil
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", x.Type(), op, y.Type())
+}
+
+func (r *Regexp) Attr(name string) (skylark.Value, error) {
+	if name == "pattern" {
+		return skylark.String(r.re.String()), nil
+	}
+	if m := methods[name]; m != nil {
+		return m.BindReceiver(r), nil
+	}
+	return nil, nil
+}
+
+func (r *Regexp) AttrNames() []string {
+	names := []string{"pattern"}
+	for name := range methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var methods = map[string]*skylark.Builtin{
+	"findall": skylark.NewBuiltin("findall", regexp_findall),
+	"match":   skylark.NewBuiltin("match", regexp_match),
+	"search":  skylark.NewBuiltin("search", regexp_search),
+	"split":   skylark.NewBuiltin("split", regexp_split),
+	"sub":     skylark.NewBuiltin("sub", regexp_sub),
+}
+
+func regexp_match(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	r := fn.Receiver().(*Regexp)
+	var s string
+	if err := skylark.UnpackArgs("match", args, kwargs, "s", &s); err != nil {
+		return nil, err
+	}
+	loc := r.anchored.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return skylark.None, nil
+	}
+	return &Match{re: r, s: s, loc: loc}, nil
+}
+
+func regexp_search(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	r := fn.Receiver().(*Regexp)
+	var s string
+	if err := skylark.UnpackArgs("search", args, kwargs, "s", &s); err != nil {
+		return nil, err
+	}
+	loc := r.re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return skylark.None, nil
+	}
+	return &Match{re: r, s: s, loc: loc}, nil
+}
+
+// findall returns a list of all non-overlapping matches. If the
+// pattern has no groups, each element is the matched string; if it has
+// one group, each element is that group; otherwise each element is a
+// tuple of the groups. Groups that did not participate are "".
+func regexp_findall(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	r := fn.Receiver().(*Regexp)
+	var s string
+	if err := skylark.UnpackArgs("findall", args, kwargs, "s", &s); err != nil {
+		return nil, err
+	}
+	n := r.re.NumSubexp()
+	var result []skylark.Value
+	for _, loc := range r.re.FindAllStringSubmatchIndex(s, -1) {
+		switch n {
+		case 0:
+			result = append(result, group(s, loc, 0, skylark.String("")))
+		case 1:
+			result = append(result, group(s, loc, 1, skylark.String("")))
+		default:
+			groups := make(skylark.Tuple, n)
+			for i := range groups {
+				groups[i] = group(s, loc, i+1, skylark.String(""))
+			}
+			result = append(result, groups)
+		}
+	}
+	return skylark.NewList(result), nil
+}
+
+// split splits s at each match, as in Python: the text of each group
+// of the pattern is included in the result after the text preceding
+// the match, and a positive maxsplit limits the number of splits.
+func regexp_split(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	r := fn.Receiver().(*Regexp)
+	var s string
+	maxsplit := 0
+	if err := skylark.UnpackArgs("split", args, kwargs, "s", &s, "maxsplit?", &maxsplit); err != nil {
+		return nil, err
+	}
+	n := -1
+	if maxsplit > 0 {
+		n = maxsplit
+	}
+	var result []skylark.Value
+	last := 0
+	for _, loc := range r.re.FindAllStringSubmatchIndex(s, n) {
+		result = append(result, skylark.String(s[last:loc[0]]))
+		for i := 1; i <= r.re.NumSubexp(); i++ {
+			result = append(result, group(s, loc, i, skylark.None))
+		}
+		last = loc[1]
+	}
+	result = append(result, skylark.String(s[last:]))
+	return skylark.NewList(result), nil
+}
+
+// sub replaces each match, or the first count matches if count is
+// positive, by repl, which is either a template string in which $1 or
+// ${name} denotes a group, or a function that is called with a match
+// value and returns a string.
+func regexp_sub(thread *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	r := fn.Receiver().(*Regexp)
+	var repl skylark.Value
+	var s string
+	count := 0
+	if err := skylark.UnpackArgs("sub", args, kwargs, "repl", &repl, "s", &s, "count?", &count); err != nil {
+		return nil, err
+	}
+	template, isString := skylark.AsString(repl)
+	if _, ok := repl.(skylark.Callable); !ok && !isString {
+		return nil, fmt.Errorf("sub: got %s for repl, want string or function", repl.Type())
+	}
+	n := -1
+	if count > 0 {
+		n = count
+	}
+	var buf []byte
+	last := 0
+	for _, loc := range r.re.FindAllStringSubmatchIndex(s, n) {
+		buf = append(buf, s[last:loc[0]]...)
+		if isString {
+			buf = r.re.ExpandString(buf, template, s, loc)
+		} else {
+			v, err := skylark.Call(thread, repl, skylark.Tuple{&Match{re: r, s: s, loc: loc}}, nil)
+			if err != nil {
+				return nil, err // to preserve backtrace, don't modify error
+			}
+			str, ok := skylark.AsString(v)
+			if !ok {
+				return nil, fmt.Errorf("sub: repl returned %s, want string", v.Type())
+			}
+			buf = append(buf, str...)
+		}
+		last = loc[1]
+	}
+	buf = append(buf, s[last:]...)
+	return skylark.String(buf), nil
+}
+
+// group returns the text of the ith group of the match loc in s,
+// or dflt if the group did not participate in the match.
+func group(s string, loc []int, i int, dflt skylark.Value) skylark.Value {
+	if loc[2*i] < 0 {
+		return dflt
+	}
+	return skylark.String(s[loc[2*i]:loc[2*i+1]])
+}
+
+// A Match is an immutable Skylark value representing a successful
+// match of a Regexp against a string.
+type Match struct {
+	re  *Regexp
+	s   string
+	loc []int // pairs of start/end indices of each group, or -1
+}
+
+var _ skylark.HasAttrs = (*Match)(nil)
+
+func (m *Match) String() string {
+	return fmt.Sprintf("<match %s at %d:%d>", skylark.String(m.s[m.loc[0]:m.loc[1]]), m.loc[0], m.loc[1])
+}
+func (m *Match) Type() string          { return "match" }
+func (m *Match) Freeze()               {} // immutable
+func (m *Match) Shareable()            {}
+func (m *Match) Truth() skylark.Bool   { return skylark.True }
+func (m *Match) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: match") }
+
+func (m *Match) Attr(name string) (skylark.Value, error) {
+	if method := matchMethods[name]; method != nil {
+		return method.BindReceiver(m), nil
+	}
+	return nil, nil
+}
+
+func (m *Match) AttrNames() []string {
+	names := make([]string, 0, len(matchMethods))
+	for name := range matchMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// index returns the index of the group denoted by g,
+// either a group number or the name of a group.
+func (m *Match) index(fnname string, g skylark.Value) (int, error) {
+	if name, ok := skylark.AsString(g); ok {
+		if i := m.re.re.SubexpIndex(name); i >= 0 {
+			return i, nil
+		}
+		return 0, fmt.Errorf("%s: no such group %s", fnname, g)
+	}
+	i, err := skylark.AsInt32(g)
+	if err != nil {
+		return 0, fmt.Errorf("%s: got %s for group, want int or string", fnname, g.Type())
+	}
+	if i < 0 || i > m.re.re.NumSubexp() {
+		return 0, fmt.Errorf("%s: no such group %d", fnname, i)
+	}
+	return i, nil
+}
+
+var matchMethods = map[string]*skylark.Builtin{
+	"end":       skylark.NewBuiltin("end", match_end),
+	"group":     skylark.NewBuiltin("group", match_group),
+	"groupdict": skylark.NewBuiltin("groupdict", match_groupdict),
+	"groups":    skylark.NewBuiltin("groups", match_groups),
+	"start":     skylark.NewBuiltin("start", match_start),
+}
+
+// group returns the text of a single group, by default the entire
+// match, or a tuple of several groups.
+func match_group(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	m := fn.Receiver().(*Match)
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("group: unexpected keyword arguments")
+	}
+	if len(args) == 0 {
+		return group(m.s, m.loc, 0, skylark.None), nil
+	}
+	groups := make(skylark.Tuple, len(args))
+	for j, g := range args {
+		i, err := m.index("group", g)
+		if err != nil {
+			return nil, err
+		}
+		groups[j] = group(m.s, m.loc, i, skylark.None)
+	}
+	if len(groups) == 1 {
+		return groups[0], nil
+	}
+	return groups, nil
+}
+
+func match_groups(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	m := fn.Receiver().(*Match)
+	var dflt skylark.Value = skylark.None
+	if err := skylark.UnpackArgs("groups", args, kwargs, "default?", &dflt); err != nil {
+		return nil, err
+	}
+	groups := make(skylark.Tuple, m.re.re.NumSubexp())
+	for i := range groups {
+		groups[i] = group(m.s, m.loc, i+1, dflt)
+	}
+	return groups, nil
+}
+
+func match_groupdict(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	m := fn.Receiver().(*Match)
+	var dflt skylark.Value = skylark.None
+	if err := skylark.UnpackArgs("groupdict", args, kwargs, "default?", &dflt); err != nil {
+		return nil, err
+	}
+	dict := new(skylark.Dict)
+	for i, name := range m.re.re.SubexpNames() {
+		if name != "" {
+			dict.SetKey(skylark.String(name), group(m.s, m.loc, i, dflt)) // can't fail
+		}
+	}
+	return dict, nil
+}
+
+// start returns the index at which a group, by default the entire
+// match, begins, or -1 if it did not participate in the match.
+func match_start(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	m := fn.Receiver().(*Match)
+	var g skylark.Value = skylark.MakeInt(0)
+	if err := skylark.UnpackArgs("start", args, kwargs, "group?", &g); err != nil {
+		return nil, err
+	}
+	i, err := m.index("start", g)
+	if err != nil {
+		return nil, err
+	}
+	return skylark.MakeInt(m.loc[2*i]), nil
+}
+
+// end returns the index at which a group, by default the entire
+// match, ends, or -1 if it did not participate in the match.
+func match_end(_ *skylark.Thread, fn *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	m := fn.Receiver().(*Match)
+	var g skylark.Value = skylark.MakeInt(0)
+	if err := skylark.UnpackArgs("end", args, kwargs, "group?", &g); err != nil {
+		return nil, err
+	}
+	i, err := m.index("end", g)
+	if err != nil {
+		return nil, err
+	}
+	return skylark.MakeInt(m.loc[2*i+1]), nil
+}
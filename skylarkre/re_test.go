@@ -0,0 +1,46 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarkre_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/resolve"
+	"github.com/google/skylark/skylarkre"
+	"github.com/google/skylark/skylarktest"
+)
+
+func init() {
+	// The tests make extensive use of these not-yet-standard features.
+	resolve.AllowLambda = true
+	resolve.AllowFloat = true
+}
+
+func Test(t *testing.T) {
+	testdata := skylarktest.DataFile("skylark/skylarkre", ".")
+	thread := &skylark.Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	filename := filepath.Join(testdata, "testdata/re.sky")
+	predeclared := skylark.StringDict{
+		"re": skylarkre.Module,
+	}
+	if _, err := skylark.ExecFile(thread, filename, nil, predeclared); err != nil {
+		if err, ok := err.(*skylark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *skylark.Thread, module string) (skylark.StringDict, error) {
+	if module == "assert.sky" {
+		return skylarktest.LoadAssertModule()
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
@@ -0,0 +1,223 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package skylarkselect defines the Skylark 'select' type, an optional
+// language extension for configurable values in the style of Bazel.
+//
+// A call such as
+//
+//	select({"//cond:a": x, "//conditions:default": y})
+//
+// yields a value that records its alternatives without choosing among
+// them.  The choice is deferred until the application calls Resolve,
+// which consults the condition resolver associated with the thread by
+// SetResolver.
+package skylarkselect
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/syntax"
+)
+
+// DefaultCondition is the condition that is chosen when no other
+// condition of a select matches.
+const DefaultCondition = "//conditions:default"
+
+// Make is the implementation of a built-in function that creates a
+// select value from a dictionary of conditions.
+//
+// An application can add 'select' to the Skylark environment like so:
+//
+//	globals := skylark.StringDict{
+//		"select":  skylark.NewBuiltin("select", skylarkselect.Make),
+//	}
+func Make(_ *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var conditions *skylark.Dict
+	if err := skylark.UnpackPositionalArgs("select", args, kwargs, 1, &conditions); err != nil {
+		return nil, err
+	}
+	if conditions.Len() == 0 {
+		return nil, fmt.Errorf("select: empty dictionary of conditions")
+	}
+	s := &selector{keys: make([]string, 0, conditions.Len())}
+	for _, item := range conditions.Items() {
+		k, ok := skylark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("select: got %s key, want string", item[0].Type())
+		}
+		s.keys = append(s.keys, k)
+		s.values = append(s.values, item[1])
+	}
+	return &Select{parts: []skylark.Value{s}}, nil
+}
+
+// A Select is an immutable Skylark value that represents the sum of a
+// sequence of parts, each of which is either an ordinary value or a
+// choice among alternative values keyed by condition.
+//
+// A Select may be added to another value, such as a list, using the
+// + operator; the result is another Select.
+type Select struct {
+	parts []skylark.Value // each an ordinary value or a *selector
+}
+
+var (
+	_ skylark.Value     = (*Select)(nil)
+	_ skylark.HasBinary = (*Select)(nil)
+)
+
+func (x *Select) String() string {
+	var buf bytes.Buffer
+	for i, part := range x.parts {
+		if i > 0 {
+			buf.WriteString(" + ")
+		}
+		buf.WriteString(part.String())
+	}
+	return buf.String()
+}
+
+func (x *Select) Type() string        { return "select" }
+func (x *Select) Truth() skylark.Bool { return skylark.True }
+
+func (x *Select) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: select")
+}
+
+func (x *Select) Freeze() {
+	for _, part := range x.parts {
+		part.Freeze()
+	}
+}
+
+func (x *Select) Binary(op syntax.Token, y skylark.Value, side skylark.Side) (skylark.Value, error) {
+	if op != syntax.PLUS {
+		return nil, nil // unhandled
+	}
+	var parts []skylark.Value
+	if side == skylark.Left {
+		parts = append(append(parts, x.parts...), partsOf(y)...)
+	} else {
+		parts = append(append(parts, partsOf(y)...), x.parts...)
+	}
+	return &Select{parts: parts}, nil
+}
+
+func partsOf(v skylark.Value) []skylark.Value {
+	if s, ok := v.(*Select); ok {
+		return s.parts
+	}
+	return []skylark.Value{v}
+}
+
+// A selector is the part of a Select created by a single call to select.
+// It is not a true Skylark value, but implements Value for convenience.
+type selector struct {
+	keys   []string        // conditions, in order
+	values []skylark.Value // corresponding values
+}
+
+func (s *selector) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("select({")
+	for i, k := range s.keys {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(skylark.String(k).String())
+		buf.WriteString(": ")
+		buf.WriteString(s.values[i].String())
+	}
+	buf.WriteString("})")
+	return buf.String()
+}
+
+func (s *selector) Type() string          { return "select" }
+func (s *selector) Truth() skylark.Bool   { return skylark.True }
+func (s *selector) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: select") }
+
+func (s *selector) Freeze() {
+	for _, v := range s.values {
+		v.Freeze()
+	}
+}
+
+// choose returns the value of the sole matching condition of s,
+// or that of DefaultCondition if no other condition matches.
+func (s *selector) choose(thread *skylark.Thread, resolver Resolver) (skylark.Value, error) {
+	match, deflt := -1, -1
+	for i, k := range s.keys {
+		if k == DefaultCondition {
+			deflt = i
+			continue
+		}
+		ok, err := resolver(thread, k)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if match >= 0 {
+				return nil, fmt.Errorf("select: conditions %q and %q both match", s.keys[match], k)
+			}
+			match = i
+		}
+	}
+	if match < 0 {
+		match = deflt
+	}
+	if match < 0 {
+		return nil, fmt.Errorf("select: no condition matches, and there is no %q condition", DefaultCondition)
+	}
+	return s.values[match], nil
+}
+
+// A Resolver reports whether the specified condition holds.
+type Resolver func(thread *skylark.Thread, condition string) (bool, error)
+
+const localKey = "skylarkselect.Resolver"
+
+// SetResolver associates a condition resolver with the Skylark thread,
+// for use by Resolve.
+func SetResolver(thread *skylark.Thread, resolver Resolver) {
+	thread.SetLocal(localKey, resolver)
+}
+
+// Resolve returns the value of v in the configuration described by the
+// thread's resolver.  If v is a Select, each of its choices is resolved
+// and the resulting parts are added together using the + operator;
+// otherwise v is returned unchanged.
+// Resolve fails if v is a Select and SetResolver has not been called.
+func Resolve(thread *skylark.Thread, v skylark.Value) (skylark.Value, error) {
+	sel, ok := v.(*Select)
+	if !ok {
+		return v, nil
+	}
+	resolver, ok := thread.Local(localKey).(Resolver)
+	if !ok {
+		return nil, fmt.Errorf("select: no resolver associated with thread")
+	}
+	var result skylark.Value
+	for _, part := range sel.parts {
+		if s, ok := part.(*selector); ok {
+			var err error
+			part, err = s.choose(thread, resolver)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if result == nil {
+			result = part
+			continue
+		}
+		z, err := skylark.Binary(syntax.PLUS, result, part)
+		if err != nil {
+			return nil, fmt.Errorf("select: %v", err)
+		}
+		result = z
+	}
+	return result, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarkselect_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/resolve"
+	"github.com/google/skylark/skylarkselect"
+	"github.com/google/skylark/skylarktest"
+)
+
+func init() {
+	// The tests make extensive use of these not-yet-standard features.
+	resolve.AllowLambda = true
+	resolve.AllowNestedDef = true
+}
+
+func Test(t *testing.T) {
+	testdata := skylarktest.DataFile("skylark/skylarkselect", ".")
+	thread := &skylark.Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	skylarkselect.SetResolver(thread, func(_ *skylark.Thread, condition string) (bool, error) {
+		switch condition {
+		case "//os:linux", "//cpu:x86_64":
+			return true, nil
+		case "//bad":
+			return false, fmt.Errorf("invalid condition %s", condition)
+		}
+		return false, nil
+	})
+	filename := filepath.Join(testdata, "testdata/select.sky")
+	predeclared := skylark.StringDict{
+		"select":  skylark.NewBuiltin("select", skylarkselect.Make),
+		"resolve": skylark.NewBuiltin("resolve", resolve_),
+	}
+	if _, err := skylark.ExecFile(thread, filename, nil, predeclared); err != nil {
+		if err, ok := err.(*skylark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *skylark.Thread, module string) (skylark.StringDict, error) {
+	if module == "assert.sky" {
+		return skylarktest.LoadAssertModule()
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
+
+// resolve_ is a built-in function that resolves a select value.
+func resolve_(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var x skylark.Value
+	if err := skylark.UnpackPositionalArgs("resolve", args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	return skylarkselect.Resolve(thread, x)
+}
+
+func TestNoResolver(t *testing.T) {
+	thread := new(skylark.Thread)
+	predeclared := skylark.StringDict{
+		"select": skylark.NewBuiltin("select", skylarkselect.Make),
+	}
+	v, err := skylark.Eval(thread, "<expr>", `select({"//a": 1})`, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = skylarkselect.Resolve(thread, v)
+	if want := "select: no resolver associated with thread"; fmt.Sprint(err) != want {
+		t.Errorf("Resolve without resolver: got %v, want %q", err, want)
+	}
+}
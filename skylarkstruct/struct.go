@@ -40,6 +40,11 @@ import (
 // 		"struct":  skylark.NewBuiltin("struct", skylarkstruct.Make),
 // 	}
 //
+// or, to make it available to all modules, add it to the universe
+// before execution begins:
+//
+// 	skylark.Universe["struct"] = skylark.NewBuiltin("struct", skylarkstruct.Make)
+//
 func Make(_ *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
 	if len(args) > 0 {
 		return nil, fmt.Errorf("struct: unexpected positional arguments")
@@ -178,6 +183,16 @@ func (s *Struct) Freeze() {
 	}
 }
 
+// Clone returns a copy of the struct whose field values are replaced
+// by their copies.  It is called by skylark.Clone.
+func (s *Struct) Clone(copy func(skylark.Value) skylark.Value) skylark.Value {
+	entries := make(entries, len(s.entries))
+	for i, e := range s.entries {
+		entries[i] = entry{e.name, copy(e.value)}
+	}
+	return &Struct{constructor: s.constructor, entries: entries}
+}
+
 func (x *Struct) Binary(op syntax.Token, y skylark.Value, side skylark.Side) (skylark.Value, error) {
 	if y, ok := y.(*Struct); ok && op == syntax.PLUS {
 		if side == skylark.Right {
@@ -197,6 +212,9 @@ func (x *Struct) Binary(op syntax.Token, y skylark.Value, side skylark.Side) (sk
 			z[e.name] = e.value
 		}
 		for _, e := range y.entries {
+			if _, ok := z[e.name]; ok {
+				return nil, fmt.Errorf("cannot add structs with common field %s", e.name)
+			}
 			z[e.name] = e.value
 		}
 
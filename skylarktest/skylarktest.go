@@ -65,6 +65,7 @@ func LoadAssertModule() (skylark.StringDict, error) {
 			"matches": skylark.NewBuiltin("matches", matches),
 			"struct":  skylark.NewBuiltin("struct", skylarkstruct.Make),
 			"_freeze": skylark.NewBuiltin("freeze", freeze),
+			"_clone":  skylark.NewBuiltin("clone", clone),
 		}
 		filename := DataFile("skylark/skylarktest", "assert.sky")
 		thread := new(skylark.Thread)
@@ -128,6 +129,17 @@ func freeze(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwar
 	return args[0], nil
 }
 
+// clone(x) returns a deep, unfrozen copy of its operand.
+func clone(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("clone does not accept keyword arguments")
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("clone got %d arguments, wants 1", len(args))
+	}
+	return skylark.Clone(args[0]), nil
+}
+
 // DataFile returns the effective filename of the specified
 // test data resource.  The function abstracts differences between
 // 'go build', under which a test runs in its package directory,
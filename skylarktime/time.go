@@ -0,0 +1,254 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package skylarktime defines the Skylark 'time' module,
+// an optional language extension.
+//
+// The module provides two opaque value types, time and duration.
+// Subtracting one time from another yields a duration, and a duration
+// may be added to or subtracted from a time.  Durations support
+// arithmetic with other durations and with numbers, which are
+// interpreted as seconds.
+//
+// Because the result of time.now() depends on the environment,
+// it is disabled unless the application explicitly enables it for a
+// thread by calling SetClock.  All other operations are deterministic.
+package skylarktime
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/syntax"
+)
+
+// Module is the 'time' module.
+//
+// An application can add 'time' to the Skylark environment like so:
+//
+//	globals := skylark.StringDict{
+//		"time":  skylarktime.Module,
+//	}
+var Module skylark.Value = &module{
+	name: "time",
+	members: skylark.StringDict{
+		"now":   skylark.NewBuiltin("now", now).WithSignature(),
+		"parse": skylark.NewBuiltin("parse", parse).WithSignature("layout", "s"),
+	},
+}
+
+const localKey = "skylarktime.clock"
+
+// SetClock enables the time.now function for the specified thread.
+// Calls to time.now return the result of calling clock,
+// which is typically time.Now.
+// By default, time.now fails, so that the results of
+// Skylark programs do not depend on when they are executed.
+func SetClock(thread *skylark.Thread, clock func() time.Time) {
+	thread.SetLocal(localKey, clock)
+}
+
+func now(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	if err := skylark.UnpackPositionalArgs("now", args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	clock, _ := thread.Local(localKey).(func() time.Time)
+	if clock == nil {
+		return nil, fmt.Errorf("now: disabled by application")
+	}
+	return Time(clock()), nil
+}
+
+func parse(thread *skylark.Thread, _ *skylark.Builtin, args skylark.Tuple, kwargs []skylark.Tuple) (skylark.Value, error) {
+	var layout, s string
+	if err := skylark.UnpackArgs("parse", args, kwargs, "layout", &layout, "s", &s); err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %v", err)
+	}
+	return Time(t), nil
+}
+
+// A module is a named collection of built-in values.
+type module struct {
+	name    string
+	members skylark.StringDict
+}
+
+var _ skylark.HasAttrs = (*module)(nil)
+
+func (m *module) String() string        { return fmt.Sprintf("<module %s>", m.name) }
+func (m *module) Type() string          { return "module" }
+func (m *module) Freeze()               {} // immutable
+func (m *module) Truth() skylark.Bool   { return skylark.True }
+func (m *module) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", m.Type()) }
+
+func (m *module) Attr(name string) (skylark.Value, error) { return m.members[name], nil }
+
+func (m *module) AttrNames() []string {
+	names := make([]string, 0, len(m.members))
+	for name := range m.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A Time is an opaque Skylark value representing an instant in time.
+type Time time.Time
+
+var (
+	_ skylark.Comparable = Time{}
+	_ skylark.HasBinary  = Time{}
+)
+
+func (t Time) String() string        { return time.Time(t).Format(time.RFC3339Nano) }
+func (t Time) Type() string          { return "time" }
+func (t Time) Freeze()               {} // immutable
+func (t Time) Shareable()            {}
+func (t Time) Truth() skylark.Bool   { return skylark.Bool(!time.Time(t).IsZero()) }
+func (t Time) Hash() (uint32, error) { return hashInt64(time.Time(t).UnixNano()), nil }
+
+func (x Time) CompareSameType(op syntax.Token, y_ skylark.Value, depth int) (bool, error) {
+	y := y_.(Time)
+	return threeway(op, time.Time(x).Compare(time.Time(y))), nil
+}
+
+func (x Time) Binary(op syntax.Token, y skylark.Value, side skylark.Side) (skylark.Value, error) {
+	switch op {
+	case syntax.PLUS:
+		// time + duration, duration + time
+		if d, ok := y.(Duration); ok {
+			return Time(time.Time(x).Add(time.Duration(d))), nil
+		}
+	case syntax.MINUS:
+		if side == skylark.Right {
+			break
+		}
+		switch y := y.(type) {
+		case Time:
+			return Duration(time.Time(x).Sub(time.Time(y))), nil
+		case Duration:
+			return Time(time.Time(x).Add(-time.Duration(y))), nil
+		}
+	}
+	return nil, nil // unhandled
+}
+
+// A Duration is a Skylark value representing the elapsed time between
+// two instants.
+type Duration time.Duration
+
+var (
+	_ skylark.Comparable = Duration(0)
+	_ skylark.HasBinary  = Duration(0)
+)
+
+// String returns the duration in the form "1h30m", omitting zero
+// minutes and seconds after a larger unit.
+func (d Duration) String() string {
+	s := time.Duration(d).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-len("0s")]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-len("0m")]
+	}
+	return s
+}
+func (d Duration) Type() string          { return "duration" }
+func (d Duration) Freeze()               {} // immutable
+func (d Duration) Shareable()            {}
+func (d Duration) Truth() skylark.Bool   { return d != 0 }
+func (d Duration) Hash() (uint32, error) { return hashInt64(int64(d)), nil }
+
+func (x Duration) CompareSameType(op syntax.Token, y_ skylark.Value, depth int) (bool, error) {
+	y := y_.(Duration)
+	cmp := 0
+	if x < y {
+		cmp = -1
+	} else if x > y {
+		cmp = +1
+	}
+	return threeway(op, cmp), nil
+}
+
+func (x Duration) Binary(op syntax.Token, y skylark.Value, side skylark.Side) (skylark.Value, error) {
+	if y, ok := y.(Duration); ok {
+		switch op {
+		case syntax.PLUS:
+			return x + y, nil
+		case syntax.MINUS:
+			if side == skylark.Right {
+				x, y = y, x
+			}
+			return x - y, nil
+		case syntax.SLASH:
+			if side == skylark.Right {
+				x, y = y, x
+			}
+			if y == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return skylark.Float(float64(x) / float64(y)), nil
+		}
+		return nil, nil // unhandled
+	}
+
+	secs, ok := skylark.AsFloat(y)
+	if !ok {
+		return nil, nil // unhandled
+	}
+	switch op {
+	case syntax.PLUS:
+		// duration + seconds, seconds + duration
+		return x + seconds(secs), nil
+	case syntax.MINUS:
+		if side == skylark.Right {
+			return seconds(secs) - x, nil
+		}
+		return x - seconds(secs), nil
+	case syntax.STAR:
+		return Duration(float64(x) * secs), nil
+	case syntax.SLASH:
+		if side == skylark.Right {
+			break // number / duration
+		}
+		if secs == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return Duration(float64(x) / secs), nil
+	}
+	return nil, nil // unhandled
+}
+
+// seconds converts a number of seconds to a Duration.
+func seconds(secs float64) Duration { return Duration(secs * float64(time.Second)) }
+
+func hashInt64(x int64) uint32 { return uint32(x) ^ uint32(x>>32) }
+
+// threeway interprets a three-way comparison value cmp (-1, 0, +1)
+// as a boolean comparison (e.g. x < y).
+func threeway(op syntax.Token, cmp int) bool {
+	switch op {
+	case syntax.EQL:
+		return cmp == 0
+	case syntax.NEQ:
+		return cmp != 0
+	case syntax.LE:
+		return cmp <= 0
+	case syntax.LT:
+		return cmp < 0
+	case syntax.GE:
+		return cmp >= 0
+	case syntax.GT:
+		return cmp > 0
+	}
+	panic(op)
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package skylarktime_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/skylark"
+	"github.com/google/skylark/resolve"
+	"github.com/google/skylark/skylarktest"
+	"github.com/google/skylark/skylarktime"
+)
+
+func init() {
+	// The tests make extensive use of these not-yet-standard features.
+	resolve.AllowLambda = true
+	resolve.AllowFloat = true
+}
+
+func Test(t *testing.T) {
+	testdata := skylarktest.DataFile("skylark/skylarktime", ".")
+	thread := &skylark.Thread{Load: load}
+	skylarktest.SetReporter(thread, t)
+	skylarktime.SetClock(thread, func() time.Time {
+		return time.Date(2018, 3, 14, 15, 9, 26, 0, time.UTC)
+	})
+	filename := filepath.Join(testdata, "testdata/time.sky")
+	predeclared := skylark.StringDict{
+		"time": skylarktime.Module,
+	}
+	if _, err := skylark.ExecFile(thread, filename, nil, predeclared); err != nil {
+		if err, ok := err.(*skylark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *skylark.Thread, module string) (skylark.StringDict, error) {
+	if module == "assert.sky" {
+		return skylarktest.LoadAssertModule()
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
+
+func TestNowDisabledByDefault(t *testing.T) {
+	thread := new(skylark.Thread)
+	predeclared := skylark.StringDict{
+		"time": skylarktime.Module,
+	}
+	_, err := skylark.Eval(thread, "<expr>", `time.now()`, predeclared)
+	if want := "now: disabled by application"; fmt.Sprint(err) != want {
+		t.Errorf("time.now without clock: got %v, want %q", err, want)
+	}
+}
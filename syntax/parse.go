@@ -370,6 +370,7 @@ func (p *parser) consume(t Token) Position {
 //       | IDENT EQ test
 //       | STAR IDENT
 //       | STARSTAR IDENT
+//       | SLASH
 //
 // parseParams parses a parameter list.  The resulting expressions are of the form:
 //
@@ -377,6 +378,7 @@ func (p *parser) consume(t Token) Position {
 //      *Binary{Op: EQ, X: *Ident, Y: Expr}
 //      *Unary{Op: STAR, X: *Ident}
 //      *Unary{Op: STARSTAR, X: *Ident}
+//      *Unary{Op: SLASH, X: nil}         (end of positional-only parameters)
 func (p *parser) parseParams() []Expr {
 	var params []Expr
 	stars := false
@@ -418,6 +420,16 @@ func (p *parser) parseParams() []Expr {
 			continue
 		}
 
+		// / (marks the end of the positional-only parameters)
+		if p.tok == SLASH {
+			pos := p.nextToken()
+			params = append(params, &UnaryExpr{
+				OpPos: pos,
+				Op:    SLASH,
+			})
+			continue
+		}
+
 		// IDENT
 		// IDENT = test
 		id := p.parseIdent()
@@ -168,6 +168,8 @@ else:
 			`(DefStmt Name=f Function=(Function Params=(a b (BinaryExpr X=c Op== Y=d)) Body=((BranchStmt Token=pass))))`},
 		{`def f(a, b=c, d): pass`,
 			`(DefStmt Name=f Function=(Function Params=(a (BinaryExpr X=b Op== Y=c) d) Body=((BranchStmt Token=pass))))`}, // TODO(adonovan): fix this
+		{`def f(a, /, b=c): pass`,
+			`(DefStmt Name=f Function=(Function Params=(a (UnaryExpr Op=/) (BinaryExpr X=b Op== Y=c)) Body=((BranchStmt Token=pass))))`},
 		{`def f():
 	def g():
 		pass
@@ -321,6 +323,10 @@ func writeTree(out *bytes.Buffer, x reflect.Value) {
 					fmt.Fprintf(out, " %s", name)
 				}
 				continue
+			case reflect.Int:
+				if f.Int() == 0 {
+					continue
+				}
 			}
 			fmt.Fprintf(out, " %s=", name)
 			writeTree(out, f)
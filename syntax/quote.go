@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // unesc maps single-letter chars following \ to their actual values.
@@ -93,9 +94,38 @@ func unquote(quoted string) (s string, triple bool, err error) {
 	}
 
 	// Otherwise process quoted string.
+	var buf bytes.Buffer
+	if err = unescape(&buf, quoted, unquoteChars, false); err != nil {
+		return
+	}
+	s = buf.String()
+	return
+}
+
+// Unescape returns the string denoted by s, interpreting backslash
+// escape sequences as in a quoted string literal, such as \n, \t, \\,
+// octal \NNN, and hexadecimal \xNN.  In addition, Unescape accepts the
+// escapes \uNNNN and \UNNNNNNNN, which denote the UTF-8 encoding of a
+// Unicode code point.  As in a string literal, a backslash that does
+// not begin a known escape sequence denotes itself.
+func Unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var buf bytes.Buffer
+	if err := unescape(&buf, s, `\`, true); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// unescape writes to buf the string denoted by quoted, interpreting
+// escape sequences and carriage returns, if these are among the
+// unquoteChars.  The \u and \U escapes are recognized only if
+// unicode is set.
+func unescape(buf *bytes.Buffer, quoted, unquoteChars string, unicode bool) error {
 	// Each iteration processes one escape sequence along with the
 	// plain text leading up to it.
-	var buf bytes.Buffer
 	for {
 		// Remove prefix before escape sequence.
 		i := strings.IndexAny(quoted, unquoteChars)
@@ -122,8 +152,7 @@ func unquote(quoted string) (s string, triple bool, err error) {
 
 		// Process escape sequence.
 		if len(quoted) == 1 {
-			err = fmt.Errorf(`truncated escape sequence \`)
-			return
+			return fmt.Errorf(`truncated escape sequence \`)
 		}
 
 		switch quoted[1] {
@@ -157,29 +186,45 @@ func unquote(quoted string) (s string, triple bool, err error) {
 				// NOTE: Python silently discards the high bit,
 				// so that '\541' == '\141' == 'a'.
 				// Let's see if we can avoid doing that in BUILD files.
-				err = fmt.Errorf(`invalid escape sequence \%03o`, n)
-				return
+				return fmt.Errorf(`invalid escape sequence \%03o`, n)
 			}
 			buf.WriteByte(byte(n))
 
 		case 'x':
 			// Hexadecimal escape, exactly 2 digits.
 			if len(quoted) < 4 {
-				err = fmt.Errorf(`truncated escape sequence %s`, quoted)
-				return
+				return fmt.Errorf(`truncated escape sequence %s`, quoted)
 			}
-			n, err1 := strconv.ParseInt(quoted[2:4], 16, 0)
-			if err1 != nil {
-				err = fmt.Errorf(`invalid escape sequence %s`, quoted[:4])
-				return
+			n, err := strconv.ParseInt(quoted[2:4], 16, 0)
+			if err != nil {
+				return fmt.Errorf(`invalid escape sequence %s`, quoted[:4])
 			}
 			buf.WriteByte(byte(n))
 			quoted = quoted[4:]
+
+		case 'u', 'U':
+			if !unicode {
+				buf.WriteString(quoted[:2])
+				quoted = quoted[2:]
+				break
+			}
+			// Unicode escape, exactly 4 or 8 digits.
+			sz := 6
+			if quoted[1] == 'U' {
+				sz = 10
+			}
+			if len(quoted) < sz {
+				return fmt.Errorf(`truncated escape sequence %s`, quoted)
+			}
+			n, err := strconv.ParseUint(quoted[2:sz], 16, 0)
+			if err != nil || n > utf8.MaxRune || 0xD800 <= n && n < 0xE000 {
+				return fmt.Errorf(`invalid escape sequence %s`, quoted[:sz])
+			}
+			buf.WriteRune(rune(n))
+			quoted = quoted[sz:]
 		}
 	}
-
-	s = buf.String()
-	return
+	return nil
 }
 
 // indexByte returns the index of the first instance of b in s, or else -1.
@@ -69,3 +69,34 @@ func TestUnquote(t *testing.T) {
 		}
 	}
 }
+
+func TestUnescape(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{``, ""},
+		{`plain`, "plain"},
+		{`a\nb\tc`, "a\nb\tc"},
+		{`\\n`, `\n`},
+		{`\"\'`, `"'`},
+		{`\101\x42`, "AB"},
+		{`\u00e9\U0001F600`, "é😀"},
+		{`\(\z`, `\(\z`}, // unknown escapes denote themselves
+		{"a\r\nb", "a\r\nb"},
+		{`\`, "error: truncated escape sequence \\"},
+		{`\x4`, `error: truncated escape sequence \x4`},
+		{`\xzz`, `error: invalid escape sequence \xzz`},
+		{`\u12`, `error: truncated escape sequence \u12`},
+		{`\ud800`, `error: invalid escape sequence \ud800`},
+		{`\U00110000`, `error: invalid escape sequence \U00110000`},
+		{`\400`, `error: invalid escape sequence \400`},
+	} {
+		got, err := Unescape(test.in)
+		if err != nil {
+			got = "error: " + err.Error()
+		}
+		if got != test.want {
+			t.Errorf("Unescape(%#q) = %#q, want %#q", test.in, got, test.want)
+		}
+	}
+}
@@ -121,14 +121,15 @@ func (x *AssignStmt) Span() (start, end Position) {
 type Function struct {
 	commentsRef
 	StartPos Position // position of DEF or LAMBDA token
-	Params   []Expr   // param = ident | ident=expr | *ident | **ident
+	Params   []Expr   // param = ident | ident=expr | *ident | **ident | /
 	Body     []Stmt
 
 	// set by resolver:
-	HasVarargs bool     // whether params includes *args (convenience)
-	HasKwargs  bool     // whether params includes **kwargs (convenience)
-	Locals     []*Ident // this function's local variables, parameters first
-	FreeVars   []*Ident // enclosing local variables to capture in closure
+	HasVarargs        bool     // whether params includes *args (convenience)
+	HasKwargs         bool     // whether params includes **kwargs (convenience)
+	NumPositionalOnly int      // number of params preceding / (convenience)
+	Locals            []*Ident // this function's local variables, parameters first
+	FreeVars          []*Ident // enclosing local variables to capture in closure
 }
 
 func (x *Function) Span() (start, end Position) {
@@ -469,10 +470,13 @@ type UnaryExpr struct {
 	commentsRef
 	OpPos Position
 	Op    Token
-	X     Expr
+	X     Expr // nil for the / parameter marker
 }
 
 func (x *UnaryExpr) Span() (start, end Position) {
+	if x.X == nil {
+		return x.OpPos, x.OpPos.add("/")
+	}
 	_, end = x.X.Span()
 	return x.OpPos, end
 }
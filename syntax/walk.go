@@ -122,7 +122,9 @@ func Walk(n Node, f func(Node) bool) {
 		}
 
 	case *UnaryExpr:
-		Walk(n.X, f)
+		if n.X != nil {
+			Walk(n.X, f)
+		}
 
 	case *BinaryExpr:
 		Walk(n.X, f)
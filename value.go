@@ -26,6 +26,8 @@
 //      Callable        -- value is callable like a function
 //      Comparable      -- value defines its own comparison operations
 //      Iterable        -- value is iterable using 'for' loops
+//      LenHinter       -- value is iterable sequence of estimated length
+//      ThreadIterable  -- value is iterable using the iterating thread
 //      Sequence        -- value is iterable sequence of known length
 //      Indexable       -- value is sequence with efficient random access
 //      Mapping         -- value maps from keys to values, like a dictionary
@@ -34,12 +36,15 @@
 //      HasSetField     -- value has settable fields x.f
 //      HasSetIndex     -- value supports element update using x[i]=y
 //      HasSetKey       -- value supports map update using x[k]=v
+//      HasStr          -- value has a str(x) form distinct from its repr(x)
 //
 // Client applications may also define domain-specific functions in Go
 // and make them available to Skylark programs.  Use NewBuiltin to
 // construct a built-in value that wraps a Go function.  The
 // implementation of the Go function may use UnpackArgs to make sense of
 // the positional and keyword arguments provided by the caller.
+// A Go function that produces a sequence lazily may return a Generator,
+// constructed by NewGenerator.
 //
 // Skylark's None value is not equal to Go's nil, but nil may be
 // assigned to a Skylark Value.  Be careful to avoid allowing Go nil
@@ -71,6 +76,7 @@ import (
 	"math"
 	"math/big"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -161,11 +167,40 @@ var (
 // An iterable value may be iterated over by a 'for' loop or used where
 // any other Skylark iterable is allowed.  Unlike a Sequence, the length
 // of an Iterable is not necessarily known in advance of iteration.
+//
+// An Iterable whose elements are computed by an operation that may
+// fail, such as a call to a Skylark function or a read from a file,
+// should return a FailableIterator, so that the failure is reported
+// by the 'for' loop or built-in function that consumed the elements
+// rather than silently truncating the sequence.  NewFailableGenerator
+// is a convenient way to define such an Iterable.
 type Iterable interface {
 	Value
 	Iterate() Iterator // must be followed by call to Iterator.Done
 }
 
+// A ThreadIterable is an Iterable whose elements are computed by
+// calling Skylark functions, which must run in the thread that
+// performs the iteration, not the thread that created the value.
+// The evaluator and built-in functions iterate using the IterateThread
+// function, which prefers the IterateThread method to Iterate.
+// Iterate, used by clients that have no thread, may return an
+// iterator that fails.
+type ThreadIterable interface {
+	Iterable
+	IterateThread(thread *Thread) Iterator // must be followed by call to Iterator.Done
+}
+
+// A LenHinter is an Iterable whose length is not known in advance of
+// iteration, but that can cheaply estimate it.  Built-in functions that
+// materialize an iterable, such as list and sorted, use the estimate
+// only to preallocate storage, so it need not be exact; ideally it is
+// a close upper bound.  A negative estimate means no estimate.
+type LenHinter interface {
+	Iterable
+	EstimatedLen() int
+}
+
 // A Sequence is a sequence of values of known length.
 type Sequence interface {
 	Iterable
@@ -228,6 +263,9 @@ var (
 //	for iter.Next(&x) {
 //		...
 //	}
+//	if err := IterErr(iter); err != nil {
+//		...
+//	}
 //
 type Iterator interface {
 	// If the iterator is exhausted, Next returns false.
@@ -237,6 +275,33 @@ type Iterator interface {
 	Done()
 }
 
+// A FailableIterator is an Iterator whose sequence may end early
+// because of an error, such as an error from a function that computes
+// the elements lazily.  Next reports the failure by returning false,
+// as if the sequence were exhausted, after which Err returns the error.
+// Err returns nil while the iteration is in progress and after it
+// ends normally, and subsequent calls to Next return false.
+// Done must still be called after a failure.
+//
+// Callers that iterate to completion should call IterErr once Next
+// has returned false, and fail if it returns an error.  Every 'for'
+// loop and built-in function that consumes an iterable does so.
+// Iterators that do not implement this interface cannot fail, so the
+// existing Iterator interface remains sufficient for them.
+type FailableIterator interface {
+	Iterator
+	Err() error // error that ended the iteration, or nil
+}
+
+// IterErr returns the error that ended the iteration by iter if it is
+// a FailableIterator, or nil otherwise.
+func IterErr(iter Iterator) error {
+	if iter, ok := iter.(FailableIterator); ok {
+		return iter.Err()
+	}
+	return nil
+}
+
 // A Mapping is a mapping from keys to values, such as a dictionary.
 type Mapping interface {
 	Value
@@ -302,6 +367,39 @@ type HasSetField interface {
 	SetField(name string, val Value) error
 }
 
+// A HasStr value has a string form for str(x) that differs from the
+// repr(x) form returned by its String method.  For example, a label
+// type might print as //foo:bar with str and as Label("//foo:bar")
+// with repr.
+//
+// The SkylarkStr method is consulted only when the value itself is
+// converted: by str, print, the %s conversion of the % operator, and
+// the default !s conversion of str.format.  Elements of containers
+// such as lists are always written using their repr form, as in Python.
+type HasStr interface {
+	Value
+	SkylarkStr() string
+}
+
+// A Cloner is an immutable value that contains other values, such as a
+// struct.  Clone calls its Clone method so that a deep copy of it
+// replaces the values it contains by their own deep copies.
+type Cloner interface {
+	Value
+	// Clone returns a copy of the value in which each component
+	// value x is replaced by copy(x).
+	Clone(copy func(Value) Value) Value
+}
+
+// A Shareable is a value whose state is fixed when it is created, so
+// that no operation, not even Freeze, can change it.  A frozen copy
+// made by frozen_copy shares such a value with the original instead
+// of rejecting it as uncopyable.
+type Shareable interface {
+	Value
+	Shareable() // marker method; does nothing
+}
+
 // NoneType is the type of None.  Its only legal value is None.
 // (We represent it as a number, not struct{}, so that None may be constant.)
 type NoneType byte
@@ -344,10 +442,34 @@ func (x Bool) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, error
 // Float is the type of a Skylark float.
 type Float float64
 
-func (f Float) String() string { return strconv.FormatFloat(float64(f), 'g', 6, 64) }
-func (f Float) Type() string   { return "float" }
-func (f Float) Freeze()        {} // immutable
-func (f Float) Truth() Bool    { return f != 0.0 }
+// String returns the shortest decimal string that, when parsed,
+// yields f, formatted like Python's repr: integral values have a
+// trailing ".0", and values whose decimal exponent is less than -4 or
+// at least 16 use scientific notation, as in 1e-05 or 1e+16.
+func (f Float) String() string {
+	switch {
+	case math.IsInf(float64(f), +1):
+		return "+inf"
+	case math.IsInf(float64(f), -1):
+		return "-inf"
+	case f != f:
+		return "nan"
+	}
+	// Find the decimal exponent of the shortest representation.
+	s := strconv.FormatFloat(float64(f), 'e', -1, 64)
+	exp, _ := strconv.Atoi(s[strings.IndexByte(s, 'e')+1:])
+	if exp < -4 || exp >= 16 {
+		return s
+	}
+	s = strconv.FormatFloat(float64(f), 'f', -1, 64)
+	if !strings.ContainsRune(s, '.') {
+		s += ".0"
+	}
+	return s
+}
+func (f Float) Type() string { return "float" }
+func (f Float) Freeze()      {} // immutable
+func (f Float) Truth() Bool  { return f != 0.0 }
 func (f Float) Hash() (uint32, error) {
 	// Equal float and int values must yield the same hash.
 	// TODO(adonovan): opt: if f is non-integral, and thus not equal
@@ -399,7 +521,16 @@ func AsFloat(x Value) (f float64, ok bool) {
 	return 0, false
 }
 
-func (x Float) Mod(y Float) Float { return Float(math.Mod(float64(x), float64(y))) }
+// Mod returns the remainder of x divided by y.
+// As in Python, the sign of a nonzero result is that of y.
+// Precondition: y is nonzero.
+func (x Float) Mod(y Float) Float {
+	z := Float(math.Mod(float64(x), float64(y)))
+	if z != 0 && (z < 0) != (y < 0) {
+		z += y
+	}
+	return z
+}
 
 // String is the type of a Skylark string.
 //
@@ -556,11 +687,17 @@ func (fn *Function) Param(i int) (string, syntax.Position) {
 func (fn *Function) HasVarargs() bool { return fn.funcode.HasVarargs }
 func (fn *Function) HasKwargs() bool  { return fn.funcode.HasKwargs }
 
+// NumPositionalOnly returns the number of leading parameters,
+// those preceding / in the declaration, that may not be passed by keyword.
+func (fn *Function) NumPositionalOnly() int { return fn.funcode.NumPositionalOnly }
+
 // A Builtin is a function implemented in Go.
 type Builtin struct {
 	name string
 	fn   func(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	recv Value // for bound methods (e.g. "".startswith)
+
+	params []string // documented parameters, if known (see WithSignature)
 }
 
 func (b *Builtin) Name() string { return b.name }
@@ -604,10 +741,33 @@ func NewBuiltin(name string, fn func(thread *Thread, fn *Builtin, args Tuple, kw
 //     "abc".index("a")
 //
 func (b *Builtin) BindReceiver(recv Value) *Builtin {
-	return &Builtin{name: b.name, fn: b.fn, recv: recv}
+	return &Builtin{name: b.name, fn: b.fn, recv: recv, params: b.params}
+}
+
+// WithSignature returns a copy of the built-in function that reports
+// the specified parameter names from its Signature method.
+// The names follow the conventions of UnpackArgs: a name ending in "?"
+// denotes an optional parameter, names prefixed with "*" or "**"
+// denote the variadic parameters, and a bare "*" precedes the
+// keyword-only parameters.
+//
+// The signature is documentation only, for the benefit of tools such
+// as editors; it has no effect on how arguments are processed.
+func (b *Builtin) WithSignature(params ...string) *Builtin {
+	if params == nil {
+		params = []string{} // known to have no parameters
+	}
+	return &Builtin{name: b.name, fn: b.fn, recv: b.recv, params: params}
 }
 
+// Signature returns the documented parameter names of the built-in
+// function, as specified by WithSignature, or nil if unknown.
+// The caller must not modify the result.
+func (b *Builtin) Signature() []string { return b.params }
+
 // A *Dict represents a Skylark dictionary.
+// Its keys are ordered by first insertion: SetKey of an existing key
+// updates its value in place, without changing its position.
 type Dict struct {
 	ht hashtable
 }
@@ -813,9 +973,11 @@ type Tuple []Value
 func (t Tuple) Len() int          { return len(t) }
 func (t Tuple) Index(i int) Value { return t[i] }
 
+// Slice returns a new Tuple that shares the elements of t
+// but not its backing array.
 func (t Tuple) Slice(start, end, step int) Value {
 	if step == 1 {
-		return t[start:end]
+		return append(make(Tuple, 0, end-start), t[start:end]...)
 	}
 
 	sign := signum(step)
@@ -841,13 +1003,19 @@ func (x Tuple) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, erro
 	return sliceCompare(op, x, y, depth)
 }
 
+// Hash returns a hash of the tuple computed from the hashes of its
+// elements.  If an element is unhashable, the error identifies it by
+// its index in the innermost tuple that contains it.
 func (t Tuple) Hash() (uint32, error) {
 	// Use same algorithm as Python.
 	var x, mult uint32 = 0x345678, 1000003
-	for _, elem := range t {
+	for i, elem := range t {
 		y, err := elem.Hash()
 		if err != nil {
-			return 0, err
+			if _, ok := elem.(Tuple); ok {
+				return 0, err // already identifies the element
+			}
+			return 0, fmt.Errorf("%v (tuple element %d)", err, i)
 		}
 		x = x ^ y*mult
 		mult += 82520 + uint32(len(t)+len(t))
@@ -868,7 +1036,151 @@ func (it *tupleIterator) Next(p *Value) bool {
 
 func (it *tupleIterator) Done() {}
 
+// A Generator is an Iterable whose elements are computed lazily by
+// a Go function, such as the result of a lazy built-in function.
+// Each iteration over a Generator starts afresh.
+type Generator struct {
+	name  string
+	start func(thread *Thread) (next func() (Value, bool, error), done func())
+	hint  int // estimated length, or -1
+}
+
+// NewGenerator returns a new Generator with the specified name.
+//
+// Each call to the Iterate method of the Generator calls start, which
+// returns a function next that produces successive elements, returning
+// false when there are no more, and a function done, which releases
+// any resources held by the iteration.  The done function, if non-nil,
+// is called exactly once per iteration, when the iterator's Done method
+// is called, whether or not the iteration ran to completion.
+func NewGenerator(name string, start func() (next func() (Value, bool), done func())) *Generator {
+	return NewFailableGenerator(name, func(*Thread) (func() (Value, bool, error), func()) {
+		next, done := start()
+		return func() (Value, bool, error) {
+			v, ok := next()
+			return v, ok, nil
+		}, done
+	})
+}
+
+// NewFailableGenerator is like NewGenerator, but the next function
+// may fail.  An error ends the iteration, and is reported by the Err
+// method of the generator's iterator, which is a FailableIterator.
+//
+// The start function receives the thread performing the iteration,
+// which must be used for any calls to Skylark functions.  The thread
+// is nil if the iteration was started by Iterate, not IterateThread.
+func NewFailableGenerator(name string, start func(thread *Thread) (next func() (Value, bool, error), done func())) *Generator {
+	return &Generator{name: name, start: start, hint: -1}
+}
+
+// WithLenHint returns a copy of the Generator whose EstimatedLen
+// method returns n.
+func (g *Generator) WithLenHint(n int) *Generator {
+	g2 := *g
+	g2.hint = n
+	return &g2
+}
+
+var (
+	_ LenHinter      = (*Generator)(nil)
+	_ ThreadIterable = (*Generator)(nil)
+)
+
+func (g *Generator) EstimatedLen() int { return g.hint }
+
+func (g *Generator) Name() string          { return g.name }
+func (g *Generator) String() string        { return fmt.Sprintf("<generator %s>", g.name) }
+func (g *Generator) Type() string          { return "generator" }
+func (g *Generator) Freeze()               {} // immutable
+func (g *Generator) Truth() Bool           { return True }
+func (g *Generator) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: generator") }
+
+func (g *Generator) Iterate() Iterator { return g.IterateThread(nil) }
+
+func (g *Generator) IterateThread(thread *Thread) Iterator {
+	next, done := g.start(thread)
+	return &generatorIterator{next: next, done: done}
+}
+
+type generatorIterator struct {
+	next func() (Value, bool, error)
+	done func() // nil once called
+	err  error
+}
+
+var _ FailableIterator = (*generatorIterator)(nil)
+
+func (it *generatorIterator) Next(p *Value) bool {
+	if it.next == nil {
+		return false // exhausted or failed
+	}
+	v, ok, err := it.next()
+	if err != nil {
+		it.next = nil
+		it.err = err
+		return false
+	}
+	if !ok {
+		it.next = nil
+		return false
+	}
+	*p = v
+	return true
+}
+
+func (it *generatorIterator) Err() error { return it.err }
+
+func (it *generatorIterator) Done() {
+	if it.done != nil {
+		it.done()
+		it.done = nil
+	}
+}
+
+// A StringBuilder is a mutable Skylark value that accumulates a string
+// from many pieces in time proportional to its length, avoiding the
+// quadratic cost of repeated concatenation using +.
+// It is created by the string_builder built-in function.
+type StringBuilder struct {
+	buf    strings.Builder
+	frozen bool
+}
+
+var _ HasAttrs = (*StringBuilder)(nil)
+
+// WriteString appends s to the builder.
+// It fails if the builder is frozen.
+func (sb *StringBuilder) WriteString(s string) error {
+	if sb.frozen {
+		return fmt.Errorf("cannot append to frozen string_builder")
+	}
+	sb.buf.WriteString(s)
+	return nil
+}
+
+// Len returns the length in bytes of the string built so far.
+func (sb *StringBuilder) Len() int { return sb.buf.Len() }
+
+// Build returns the string built so far.
+func (sb *StringBuilder) Build() String { return String(sb.buf.String()) }
+
+func (sb *StringBuilder) String() string { return "<string_builder>" }
+func (sb *StringBuilder) Type() string   { return "string_builder" }
+func (sb *StringBuilder) Freeze()        { sb.frozen = true }
+func (sb *StringBuilder) Truth() Bool    { return sb.buf.Len() > 0 }
+func (sb *StringBuilder) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: string_builder")
+}
+
+func (sb *StringBuilder) Attr(name string) (Value, error) {
+	return builtinAttr(sb, name, stringBuilderMethods)
+}
+func (sb *StringBuilder) AttrNames() []string { return builtinAttrNames(stringBuilderMethods) }
+
 // A Set represents a Skylark set value.
+// Iteration over a Set, whether by Iterate or elems, yields its elements
+// in insertion order, so it is deterministic and independent of hashing.
 type Set struct {
 	ht hashtable // values are all None
 }
@@ -926,9 +1238,85 @@ func (s *Set) Union(iter Iterator) (Value, error) {
 			return nil, err
 		}
 	}
+	if err := IterErr(iter); err != nil {
+		return nil, err
+	}
 	return set, nil
 }
 
+// setMergeThreshold is the minimum number of elements in each operand
+// for which the union of two sets of strings in ascending insertion
+// order is computed by merging the two sequences, which requires no
+// hashing, instead of by hash-table lookups.
+// (Ints hash too cheaply for merging them to pay off.)
+var setMergeThreshold = 64
+
+// setUnion returns the union of sets x and y.
+func setUnion(x, y *Set) (Value, error) {
+	if mergeable(x, y) {
+		z := new(Set)
+		for e := x.ht.head; e != nil; e = e.next {
+			z.ht.insertHashed(e.key, None, e.hash) // can't fail
+		}
+		// Append the elements of y absent from x, in order.
+		ex := x.ht.head
+		for ey := y.ht.head; ey != nil; ey = ey.next {
+			for ex != nil && ex.key.(String) < ey.key.(String) {
+				ex = ex.next
+			}
+			if ex == nil || ex.key.(String) != ey.key.(String) {
+				z.ht.insertHashed(ey.key, None, ey.hash) // can't fail
+			}
+		}
+		return z, nil
+	}
+	iter := y.Iterate()
+	defer iter.Done()
+	return x.Union(iter)
+}
+
+// setIntersection returns the intersection of sets x and y.
+//
+// Unlike setUnion, it does not merge sorted sets: the merge must visit
+// every element of both sets, whereas the lookups below hash only the
+// elements of the smaller one, and measurements show them to be faster.
+func setIntersection(x, y *Set) *Set {
+	z := new(Set)
+	if x.Len() > y.Len() {
+		x, y = y, x // opt: range over smaller set
+	}
+	for _, xelem := range x.elems() {
+		// Has, Insert cannot fail here.
+		if found, _ := y.Has(xelem); found {
+			z.Insert(xelem)
+		}
+	}
+	return z
+}
+
+// mergeable reports whether sets x and y both have at least
+// setMergeThreshold elements, all strings, in strictly ascending
+// insertion order.  In that case merging yields the elements of the
+// union in the same order as hashing would.
+func mergeable(x, y *Set) bool {
+	return x.Len() >= setMergeThreshold && y.Len() >= setMergeThreshold &&
+		isSortedStrings(x) && isSortedStrings(y)
+}
+
+// isSortedStrings reports whether set s contains only strings,
+// in strictly ascending insertion order.
+func isSortedStrings(s *Set) bool {
+	var prev String
+	for e := s.ht.head; e != nil; e = e.next {
+		str, ok := e.key.(String)
+		if !ok || e != s.ht.head && prev >= str {
+			return false
+		}
+		prev = str
+	}
+	return true
+}
+
 // toString returns the string form of value v.
 // It may be more efficient than v.String() for larger values.
 func toString(v Value) string {
@@ -938,9 +1326,39 @@ func toString(v Value) string {
 	return buf.String()
 }
 
+// ReprLimit returns the string form of value v, like repr(v), but
+// writes at most limit elements of lists, tuples, dicts, and sets in
+// total, writing "..." in place of the remainder. It is intended for
+// logging values of unbounded size.
+func ReprLimit(v Value, limit int) string {
+	var buf bytes.Buffer
+	path := make([]Value, 0, 4)
+	writeValueLimit(&buf, v, path, &limit)
+	return buf.String()
+}
+
 // path is the list of *List and *Dict values we're currently printing.
 // (These are the only potentially cyclic structures.)
 func writeValue(out *bytes.Buffer, x Value, path []Value) {
+	writeValueLimit(out, x, path, nil)
+}
+
+// writeStr writes the str(x) form of x: the contents of a string,
+// the SkylarkStr form of a HasStr, or otherwise the repr form.
+func writeStr(out *bytes.Buffer, x Value, path []Value) {
+	switch x := x.(type) {
+	case String:
+		out.WriteString(string(x))
+	case HasStr:
+		out.WriteString(x.SkylarkStr())
+	default:
+		writeValue(out, x, path)
+	}
+}
+
+// writeValueLimit is like writeValue, but if budget is non-nil, it
+// writes at most *budget container elements, decrementing it for each.
+func writeValueLimit(out *bytes.Buffer, x Value, path []Value, budget *int) {
 	switch x := x.(type) {
 	case nil:
 		out.WriteString("<nil>") // indicates a bug
@@ -970,7 +1388,10 @@ func writeValue(out *bytes.Buffer, x Value, path []Value) {
 				if i > 0 {
 					out.WriteString(", ")
 				}
-				writeValue(out, elem, append(path, x))
+				if exhausted(out, budget) {
+					break
+				}
+				writeValueLimit(out, elem, append(path, x), budget)
 			}
 		}
 		out.WriteByte(']')
@@ -981,7 +1402,10 @@ func writeValue(out *bytes.Buffer, x Value, path []Value) {
 			if i > 0 {
 				out.WriteString(", ")
 			}
-			writeValue(out, elem, path)
+			if exhausted(out, budget) {
+				break
+			}
+			writeValueLimit(out, elem, path, budget)
 		}
 		if len(x) == 1 {
 			out.WriteByte(',')
@@ -1007,9 +1431,12 @@ func writeValue(out *bytes.Buffer, x Value, path []Value) {
 			for _, item := range x.Items() {
 				k, v := item[0], item[1]
 				out.WriteString(sep)
-				writeValue(out, k, path)
+				if exhausted(out, budget) {
+					break
+				}
+				writeValueLimit(out, k, path, budget)
 				out.WriteString(": ")
-				writeValue(out, v, append(path, x)) // cycle check
+				writeValueLimit(out, v, append(path, x), budget) // cycle check
 				sep = ", "
 			}
 		}
@@ -1021,7 +1448,10 @@ func writeValue(out *bytes.Buffer, x Value, path []Value) {
 			if i > 0 {
 				out.WriteString(", ")
 			}
-			writeValue(out, elem, path)
+			if exhausted(out, budget) {
+				break
+			}
+			writeValueLimit(out, elem, path, budget)
 		}
 		out.WriteString("])")
 
@@ -1030,6 +1460,20 @@ func writeValue(out *bytes.Buffer, x Value, path []Value) {
 	}
 }
 
+// exhausted reports whether the element budget, if any, is used up,
+// writing "..." if so. Otherwise it consumes one element of the budget.
+func exhausted(out *bytes.Buffer, budget *int) bool {
+	if budget == nil {
+		return false
+	}
+	if *budget <= 0 {
+		out.WriteString("...")
+		return true
+	}
+	*budget--
+	return false
+}
+
 func pathContains(path []Value, x Value) bool {
 	for _, y := range path {
 		if x == y {
@@ -1039,9 +1483,17 @@ func pathContains(path []Value, x Value) bool {
 	return false
 }
 
+// maxdepth is the default limit on the depth of recursion of Equal and
+// Compare, which bounds their work on cyclic data structures.
 const maxdepth = 10
 
 // Equal reports whether two Skylark values are equal.
+//
+// Equal compares elements of nested values to a depth of at most 10.
+// Rather than recursing without bound, it fails when comparing
+// values nested more deeply than that, such as cyclic structures
+// like a list that contains itself.  Use EqualDepth to choose
+// a different limit.
 func Equal(x, y Value) (bool, error) {
 	if x, ok := x.(String); ok {
 		return x == y, nil // fast path for an important special case
@@ -1061,6 +1513,7 @@ func EqualDepth(x, y Value, depth int) (bool, error) {
 // The comparison operation must be one of EQL, NEQ, LT, LE, GT, or GE.
 // Compare returns an error if an ordered comparison was
 // requested for a type that does not support it.
+// Like Equal, it fails when comparing values nested more than 10 deep.
 //
 // Recursive comparisons by implementations of Value.CompareSameType
 // should use CompareDepth to prevent infinite recursion.
@@ -1096,12 +1549,15 @@ func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 
 	// different types
 
-	// int/float ordered comparisons
+	// int/float comparisons
+	//
+	// These are exact: a finite float is converted to a rational
+	// rather than the int to a float, which may lose precision.
 	switch x := x.(type) {
 	case Int:
 		if y, ok := y.(Float); ok {
 			if y != y {
-				return false, nil // y is NaN
+				return op == syntax.NEQ, nil // y is NaN
 			}
 			var cmp int
 			if !math.IsInf(float64(y), 0) {
@@ -1116,15 +1572,15 @@ func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 	case Float:
 		if y, ok := y.(Int); ok {
 			if x != x {
-				return false, nil // x is NaN
+				return op == syntax.NEQ, nil // x is NaN
 			}
 			var cmp int
 			if !math.IsInf(float64(x), 0) {
 				cmp = x.rational().Cmp(y.rational()) // x is finite
 			} else if x > 0 {
-				cmp = -1 // x is +Inf
+				cmp = +1 // x is +Inf
 			} else {
-				cmp = +1 // x is -Inf
+				cmp = -1 // x is -Inf
 			}
 			return threeway(op, cmp), nil
 		}
@@ -1140,6 +1596,90 @@ func CompareDepth(op syntax.Token, x, y Value, depth int) (bool, error) {
 	return false, fmt.Errorf("%s %s %s not implemented", x.Type(), op, y.Type())
 }
 
+// compareOrdered is like CompareDepth, but it also defines an ordered
+// comparison of dicts and sets, for threads that enable it by
+// SetDictSetOrder.  A dict is ordered like the list of its items in
+// key order, and a set like the sorted list of its elements.  The
+// order applies to dicts and sets nested within lists, tuples, dicts,
+// and sets too, but not within application-defined values.
+func compareOrdered(op syntax.Token, x, y Value, depth int) (bool, error) {
+	if op == syntax.EQL || op == syntax.NEQ {
+		return CompareDepth(op, x, y, depth)
+	}
+	if depth < 1 {
+		return false, fmt.Errorf("comparison exceeded maximum recursion depth")
+	}
+	switch x := x.(type) {
+	case *List:
+		if y, ok := y.(*List); ok {
+			return orderedSliceCompare(op, x.elems, y.elems, depth)
+		}
+	case Tuple:
+		if y, ok := y.(Tuple); ok {
+			return orderedSliceCompare(op, x, y, depth)
+		}
+	case *Dict:
+		if y, ok := y.(*Dict); ok {
+			xitems, err := sortedItems(x)
+			if err != nil {
+				return false, err
+			}
+			yitems, err := sortedItems(y)
+			if err != nil {
+				return false, err
+			}
+			return orderedSliceCompare(op, xitems, yitems, depth)
+		}
+	case *Set:
+		if y, ok := y.(*Set); ok {
+			xelems, err := sortedElems(x)
+			if err != nil {
+				return false, err
+			}
+			yelems, err := sortedElems(y)
+			if err != nil {
+				return false, err
+			}
+			return orderedSliceCompare(op, xelems, yelems, depth)
+		}
+	case reversedKey:
+		if y, ok := y.(reversedKey); ok {
+			// Swapping the operands reverses the order.
+			return compareOrdered(op, y.v, x.v, depth-1)
+		}
+	}
+	return CompareDepth(op, x, y, depth)
+}
+
+// orderedSliceCompare is like sliceCompare, for compareOrdered.
+func orderedSliceCompare(op syntax.Token, x, y []Value, depth int) (bool, error) {
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if eq, err := EqualDepth(x[i], y[i], depth-1); err != nil {
+			return false, err
+		} else if !eq {
+			return compareOrdered(op, x[i], y[i], depth-1)
+		}
+	}
+	return threeway(op, len(x)-len(y)), nil
+}
+
+// sortedItems returns the items of d, in key order.
+func sortedItems(d *Dict) ([]Value, error) {
+	slice := &sortSlice{keys: d.Keys()}
+	for _, item := range d.Items() {
+		slice.values = append(slice.values, item)
+	}
+	sort.Stable(slice)
+	return slice.values, slice.err
+}
+
+// sortedElems returns the elements of s, in order.
+func sortedElems(s *Set) ([]Value, error) {
+	slice := &sortSlice{values: s.elems()}
+	sort.Stable(slice)
+	return slice.values, slice.err
+}
+
 func sameType(x, y Value) bool {
 	return reflect.TypeOf(x) == reflect.TypeOf(y) || x.Type() == y.Type()
 }
@@ -1187,6 +1727,27 @@ func Len(x Value) int {
 	return -1
 }
 
+// maxLenHint bounds the estimated length used for preallocation,
+// since an estimate may be wrong; append grows the slice beyond it.
+const maxLenHint = 1 << 16
+
+// lenHint returns the length of x if known, or else its estimated
+// length, at most maxLenHint, if x is a LenHinter, or else -1.
+func lenHint(x Value) int {
+	if n := Len(x); n >= 0 {
+		return n
+	}
+	if x, ok := x.(LenHinter); ok {
+		if n := x.EstimatedLen(); n >= 0 {
+			if n > maxLenHint {
+				n = maxLenHint
+			}
+			return n
+		}
+	}
+	return -1
+}
+
 // Iterate return a new iterator for the value if iterable, nil otherwise.
 // If the result is non-nil, the caller must call Done when finished with it.
 //
@@ -1198,3 +1759,16 @@ func Iterate(x Value) Iterator {
 	}
 	return nil
 }
+
+// IterateThread is like Iterate, but a ThreadIterable is iterated by
+// the specified thread.  Built-in functions should use it, passing
+// their own thread, to iterate over their arguments.
+func IterateThread(thread *Thread, x Value) Iterator {
+	switch x := x.(type) {
+	case ThreadIterable:
+		return x.IterateThread(thread)
+	case Iterable:
+		return x.Iterate()
+	}
+	return nil
+}
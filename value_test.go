@@ -8,9 +8,11 @@ package skylark_test
 
 import (
 	"fmt"
+	"math"
 	"testing"
 
 	"github.com/google/skylark"
+	"github.com/google/skylark/syntax"
 )
 
 func TestStringMethod(t *testing.T) {
@@ -33,6 +35,64 @@ func TestStringMethod(t *testing.T) {
 	}
 }
 
+// TestStringSlice exercises the Sliceable implementation of String,
+// whose indices, like those of the rest of the string API, are byte offsets.
+func TestStringSlice(t *testing.T) {
+	for _, test := range []struct {
+		s                string
+		start, end, step int
+		want             string
+	}{
+		{"hello", 0, 5, 1, "hello"},
+		{"hello", 1, 4, 1, "ell"},
+		{"hello", 0, 5, 2, "hlo"},
+		{"hello", 1, 5, 3, "eo"},
+		{"hello", 4, -1, -1, "olleh"},
+		{"hello", 4, -1, -2, "olh"},
+		{"hello", 3, 0, -1, "lle"},
+		{"hello", 2, 2, 1, ""},
+		{"hello", 2, 2, -1, ""},
+		{"añb", 3, -1, -1, "b\xb1\xc3a"}, // bytes, not code points
+	} {
+		got := skylark.String(test.s).Slice(test.start, test.end, test.step)
+		if got != skylark.String(test.want) {
+			t.Errorf("%q.Slice(%d, %d, %d) = %s, want %q", test.s, test.start, test.end, test.step, got, test.want)
+		}
+	}
+}
+
+// TestTupleOps checks that the results of slicing, concatenating, and
+// repeating a tuple do not share its backing array.
+func TestTupleOps(t *testing.T) {
+	one, two, three := skylark.MakeInt(1), skylark.MakeInt(2), skylark.MakeInt(3)
+	orig := skylark.Tuple{one, two, three}
+	for _, test := range []struct {
+		desc string
+		got  func() (skylark.Value, error)
+		want string
+	}{
+		{"t[0:2]", func() (skylark.Value, error) { return orig.Slice(0, 2, 1), nil }, "(1, 2)"},
+		{"t[::-1]", func() (skylark.Value, error) { return orig.Slice(2, -1, -1), nil }, "(3, 2, 1)"},
+		{"t + ()", func() (skylark.Value, error) { return skylark.Binary(syntax.PLUS, orig, skylark.Tuple{}) }, "(1, 2, 3)"},
+		{"t * 1", func() (skylark.Value, error) { return skylark.Binary(syntax.STAR, orig, one) }, "(1, 2, 3)"},
+	} {
+		v, err := test.got()
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		result := v.(skylark.Tuple)
+		if got := result.String(); got != test.want {
+			t.Errorf("%s = %s, want %s", test.desc, got, test.want)
+		}
+		// Overwriting an element of the result must not affect the original.
+		result[0] = skylark.None
+		if got := orig.String(); got != "(1, 2, 3)" {
+			t.Fatalf("after modifying %s, original tuple is %s", test.desc, got)
+		}
+	}
+}
+
 func TestListAppend(t *testing.T) {
 	l := skylark.NewList(nil)
 	l.Append(skylark.String("hello"))
@@ -44,3 +104,188 @@ func TestListAppend(t *testing.T) {
 		t.Errorf("failed list.Append() got: %+v, want: hello", res)
 	}
 }
+
+// TestFloorDivMod checks that // and % round towards negative infinity,
+// so that the sign of a nonzero remainder is that of the divisor,
+// for every combination of operand signs and types.
+func TestFloorDivMod(t *testing.T) {
+	i := func(x int) skylark.Value { return skylark.MakeInt(x) }
+	f := func(x float64) skylark.Value { return skylark.Float(x) }
+	for _, test := range []struct {
+		x, y, quo, rem skylark.Value
+	}{
+		// int, int
+		{i(7), i(2), i(3), i(1)},
+		{i(-7), i(2), i(-4), i(1)},
+		{i(7), i(-2), i(-4), i(-1)},
+		{i(-7), i(-2), i(3), i(-1)},
+		{i(6), i(-2), i(-3), i(0)},
+		{i(0), i(-2), i(0), i(0)},
+		// float, float
+		{f(5.5), f(2), f(2), f(1.5)},
+		{f(-5.5), f(2), f(-3), f(0.5)},
+		{f(5.5), f(-2), f(-3), f(-0.5)},
+		{f(-5.5), f(-2), f(2), f(-1.5)},
+		{f(6), f(-2), f(-3), f(0)},
+		// int, float
+		{i(7), f(2), f(3), f(1)},
+		{i(-7), f(2), f(-4), f(1)},
+		{i(7), f(-2), f(-4), f(-1)},
+		{i(-7), f(-2), f(3), f(-1)},
+		// float, int
+		{f(7.5), i(2), f(3), f(1.5)},
+		{f(-7.5), i(2), f(-4), f(0.5)},
+		{f(7.5), i(-2), f(-4), f(-0.5)},
+		{f(-7.5), i(-2), f(3), f(-1.5)},
+	} {
+		for _, op := range []struct {
+			tok  syntax.Token
+			want skylark.Value
+		}{
+			{syntax.SLASHSLASH, test.quo},
+			{syntax.PERCENT, test.rem},
+		} {
+			z, err := skylark.Binary(op.tok, test.x, test.y)
+			if err != nil {
+				t.Errorf("%s %s %s: %v", test.x, op.tok, test.y, err)
+				continue
+			}
+			if eq, _ := skylark.Equal(z, op.want); !eq || z.Type() != op.want.Type() {
+				t.Errorf("%s %s %s = %s %s, want %s %s",
+					test.x, op.tok, test.y, z.Type(), z, op.want.Type(), op.want)
+			}
+		}
+	}
+
+	// division by zero
+	for _, test := range []struct {
+		x, y     skylark.Value
+		quo, rem string
+	}{
+		{i(1), i(0), "floored division by zero", "integer modulo by zero"},
+		{i(1), f(0), "floored division by zero", "float modulo by zero"},
+		{f(1), i(0), "floored division by zero", "float modulo by zero"},
+		{f(1), f(0), "floored division by zero", "float modulo by zero"},
+	} {
+		if _, err := skylark.Binary(syntax.SLASHSLASH, test.x, test.y); fmt.Sprint(err) != test.quo {
+			t.Errorf("%s // %s: got error %v, want %q", test.x, test.y, err, test.quo)
+		}
+		if _, err := skylark.Binary(syntax.PERCENT, test.x, test.y); fmt.Sprint(err) != test.rem {
+			t.Errorf("%s %% %s: got error %v, want %q", test.x, test.y, err, test.rem)
+		}
+	}
+}
+
+// TestFloatString compares the string form of floats with the
+// repr of the same values in CPython.
+func TestFloatString(t *testing.T) {
+	for _, test := range []struct {
+		f    float64
+		want string
+	}{
+		{0.1, "0.1"},
+		{0.30000000000000004, "0.30000000000000004"},
+		{1.0, "1.0"},
+		{math.Copysign(0, -1), "-0.0"},
+		{0, "0.0"},
+		{1e16, "1e+16"},
+		{1e15, "1000000000000000.0"},
+		{9999999999999998, "9999999999999998.0"},
+		{1e100, "1e+100"},
+		{1e-4, "0.0001"},
+		{1e-5, "1e-05"},
+		{1.5e-7, "1.5e-07"},
+		{123.456, "123.456"},
+		{1 << 53, "9007199254740992.0"},
+		{1.0 / 3, "0.3333333333333333"},
+		{5e-324, "5e-324"},
+		{math.MaxFloat64, "1.7976931348623157e+308"},
+		{-1.5, "-1.5"},
+		{12345678901234567890.0, "1.2345678901234567e+19"},
+		{math.Inf(+1), "+inf"},
+		{math.Inf(-1), "-inf"},
+		{math.NaN(), "nan"},
+	} {
+		if got := skylark.Float(test.f).String(); got != test.want {
+			t.Errorf("Float(%g).String() = %s, want %s", test.f, got, test.want)
+		}
+	}
+}
+
+// TestEqualCycles checks that comparisons of cyclic values fail
+// rather than recursing without bound.
+func TestEqualCycles(t *testing.T) {
+	// a = [1, b] and b = [1, a]
+	a := skylark.NewList([]skylark.Value{skylark.MakeInt(1)})
+	b := skylark.NewList([]skylark.Value{skylark.MakeInt(1)})
+	a.Append(b)
+	b.Append(a)
+
+	const want = "comparison exceeded maximum recursion depth"
+	if _, err := skylark.Equal(a, b); err == nil || err.Error() != want {
+		t.Errorf("Equal(a, b) error = %v, want %q", err, want)
+	}
+	if _, err := skylark.Compare(syntax.LT, a, b); err == nil || err.Error() != want {
+		t.Errorf("Compare(<, a, b) error = %v, want %q", err, want)
+	}
+	if _, err := skylark.EqualDepth(a, b, 1000); err == nil || err.Error() != want {
+		t.Errorf("EqualDepth(a, b, 1000) error = %v, want %q", err, want)
+	}
+
+	// A dict that contains itself.
+	d := new(skylark.Dict)
+	d.SetKey(skylark.String("d"), d)
+	if _, err := skylark.Equal(d, d); err == nil || err.Error() != want {
+		t.Errorf("Equal(d, d) error = %v, want %q", err, want)
+	}
+
+	// Acyclic values nested beyond the default depth need EqualDepth.
+	nest := func(n int) skylark.Value {
+		var x skylark.Value = skylark.MakeInt(1)
+		for i := 0; i < n; i++ {
+			x = skylark.NewList([]skylark.Value{x})
+		}
+		return x
+	}
+	if eq, err := skylark.Equal(nest(9), nest(9)); !eq || err != nil {
+		t.Errorf("Equal(nest(9), nest(9)) = %t, %v, want true", eq, err)
+	}
+	if _, err := skylark.Equal(nest(20), nest(20)); err == nil {
+		t.Errorf("Equal(nest(20), nest(20)) succeeded, want error")
+	}
+	if eq, err := skylark.EqualDepth(nest(20), nest(20), 25); !eq || err != nil {
+		t.Errorf("EqualDepth(nest(20), nest(20), 25) = %t, %v, want true", eq, err)
+	}
+	if eq, err := skylark.EqualDepth(nest(20), nest(19), 25); eq || err != nil {
+		t.Errorf("EqualDepth(nest(20), nest(19), 25) = %t, %v, want false", eq, err)
+	}
+}
+
+// A box is a Cloner of comparable struct type whose field may hold an
+// uncomparable value such as a tuple.
+type box struct{ v skylark.Value }
+
+func (b box) String() string        { return fmt.Sprintf("box(%s)", b.v) }
+func (b box) Type() string          { return "box" }
+func (b box) Freeze()               { b.v.Freeze() }
+func (b box) Truth() skylark.Bool   { return skylark.True }
+func (b box) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: box") }
+func (b box) Clone(copy func(skylark.Value) skylark.Value) skylark.Value {
+	return box{copy(b.v)}
+}
+
+// TestCloneComparableCloner ensures that Clone does not use a Cloner
+// of non-pointer type as a map key, which would panic if it held a tuple.
+func TestCloneComparableCloner(t *testing.T) {
+	list := skylark.NewList(nil)
+	x := skylark.NewList([]skylark.Value{box{skylark.Tuple{list}}, box{skylark.Tuple{list}}})
+	y := skylark.Clone(x).(*skylark.List)
+	if got, want := y.String(), "[box(([],)), box(([],))]"; got != want {
+		t.Errorf("Clone(x) = %s, want %s", got, want)
+	}
+	l0 := y.Index(0).(box).v.(skylark.Tuple)[0]
+	l1 := y.Index(1).(box).v.(skylark.Tuple)[0]
+	if l0 != l1 || l0 == skylark.Value(list) {
+		t.Errorf("Clone(x) did not copy the shared list exactly once")
+	}
+}